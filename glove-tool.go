@@ -2,31 +2,52 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"io"
 	"log"
 	"math"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Vector []float64
 type Similarity struct {
-	Word  string
-	Score float64
+	Word  string  `json:"word"`
+	Score float64 `json:"score"`
 }
 
 func main() {
 	// Dispatch based on the subcommand (the first argument)
 	if len(os.Args) < 2 {
-		log.Println("Expected 'split' or 'prune' subcommands.")
+		log.Println(usage)
 		os.Exit(1)
 	}
 
@@ -35,252 +56,5786 @@ func main() {
 		runSplit(os.Args[2:])
 	case "prune":
 		runPrune(os.Args[2:])
+	case "query":
+		runQuery(os.Args[2:])
+	case "merge":
+		runMerge(os.Args[2:])
+	case "stats":
+		runStats(os.Args[2:])
+	case "normalize":
+		runNormalize(os.Args[2:])
+	case "analogy":
+		runAnalogy(os.Args[2:])
+	case "centroid":
+		runCentroid(os.Args[2:])
+	case "cohesion":
+		runCohesion(os.Args[2:])
+	case "join":
+		runJoin(os.Args[2:])
+	case "dedup":
+		runDedup(os.Args[2:])
+	case "serve":
+		runServe(os.Args[2:])
+	case "truncate":
+		runTruncate(os.Args[2:])
+	case "verify":
+		runVerify(os.Args[2:])
+	case "intra":
+		runIntra(os.Args[2:])
+	case "matrix":
+		runMatrix(os.Args[2:])
+	case "delta":
+		runDelta(os.Args[2:])
+	case "sample":
+		runSample(os.Args[2:])
+	case "diff":
+		runDiff(os.Args[2:])
+	case "vocab-intersect":
+		runVocabIntersect(os.Args[2:])
+	case "quantize":
+		runQuantize(os.Args[2:])
+	case "dequantize":
+		runDequantize(os.Args[2:])
 	default:
-		log.Println("Expected 'split' or 'prune' subcommands.")
+		log.Println(usage)
 		os.Exit(1)
 	}
+	logMemory("at the end of the run")
 }
 
+// Exit codes let scripts tell failure classes apart. Invalid flags exit with
+// 2, as the flag package does, and any other error with exitFailure. usage
+// lists them all, so keep it in step.
+const (
+	exitFailure      = 1
+	exitMissingInput = 3 // an input file doesn't exist or can't be opened
+	exitBadFormat    = 4 // malformed vectors, headers or manifests, or mismatched dimensions
+	exitNoMatches    = 5 // none of the requested words has a vector in the model
+	exitMissingVocab = 6 // a vocabulary, exclude or seed word list can't be opened
+)
+
+// fatalf logs like log.Fatalf, but exits with code. Outputs still being written
+// are discarded first, so a failed run leaves no temporary files behind.
+func fatalf(code int, format string, args ...interface{}) {
+	pendingOutputs.abortAll()
+	log.Printf(format, args...)
+	os.Exit(code)
+}
+
+// codedError carries the exit code for an error returned up to a subcommand.
+type codedError struct {
+	error
+	code int
+}
+
+func (e codedError) Unwrap() error { return e.error }
+
+func withExitCode(code int, err error) error {
+	return codedError{error: err, code: code}
+}
+
+// exitCode picks the exit code for err: its own if it has one, exitMissingInput
+// for files that can't be opened, and exitFailure otherwise.
+func exitCode(err error) int {
+	var coded codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+		return exitMissingInput
+	}
+	return exitFailure
+}
+
+const usage = `Expected a subcommand: split, join, prune, intra, matrix, delta, query, serve, merge, dedup, stats, diff, vocab-intersect, normalize, truncate, sample, quantize, dequantize, verify, centroid, cohesion or analogy.
+
+Exit codes:
+  0  success
+  1  any other failure, including a missing or unknown subcommand
+  2  invalid flags
+  3  an input file doesn't exist or can't be opened
+  4  malformed vectors, headers or manifests, or mismatched dimensions
+  5  none of the requested words has a vector in the model
+  6  a vocabulary, exclude or seed word list can't be opened`
+
 // --- SPLIT SUBCOMMAND ---
 
 func runSplit(args []string) {
 	splitCmd := flag.NewFlagSet("split", flag.ExitOnError)
-	inputFile := splitCmd.String("input", "", "Path to the large GloVe file to split.")
+	inputFile := splitCmd.String("input", "", "Path to the large GloVe file to split (.gz files are decompressed on the fly).")
 	linesPerChunk := splitCmd.Int("lines", 100000, "Number of lines per output chunk file.")
+	var maxBytes byteSize
+	splitCmd.Var(&maxBytes, "bytes", "Start a new chunk before one would exceed this size (e.g. 500000, 512K, 100M, 2G) instead of splitting by -lines.")
+	manifestFile := splitCmd.String("manifest", "", "Write a JSON manifest of the chunks (file, line count, byte size) to this path.")
+	checksum := splitCmd.Bool("checksum", false, "Record a SHA-256 of the input in the -manifest, which 'join -manifest' checks the reassembled file against.")
+	outDir := splitCmd.String("outdir", "", "Directory to write the chunks to, created if needed (default: next to the input).")
+	keepHeader := splitCmd.Bool("header", false, "Treat the first line as a header and repeat it in every chunk, rewriting a numeric '<count> <dim>' header to each chunk's count.")
+	addWriteFlags(splitCmd)
+	addCommonFlags(splitCmd)
 	splitCmd.Parse(args)
 
 	if *inputFile == "" {
 		log.Fatal("Error: -input flag is required for split command.")
 	}
+	if *checksum && *manifestFile == "" {
+		log.Fatal("Error: -checksum is recorded in the manifest, so it needs -manifest.")
+	}
+	splitCmd.Visit(func(f *flag.Flag) {
+		if f.Name == "lines" && maxBytes > 0 {
+			log.Fatal("Error: -lines and -bytes are mutually exclusive.")
+		}
+	})
+	limit := chunkLimit{lines: *linesPerChunk, bytes: int64(maxBytes)}
+	if maxBytes > 0 {
+		limit.lines = 0
+		logger.Printf("Splitting file %s into chunks of at most %s...\n", *inputFile, formatBytes(int64(maxBytes)))
+	} else if *linesPerChunk > 0 {
+		logger.Printf("Splitting file %s into chunks of %d lines...\n", *inputFile, *linesPerChunk)
+	} else {
+		log.Fatal("Error: -lines must be at least 1.")
+	}
+	if *outDir != "" {
+		if err := os.MkdirAll(*outDir, 0755); err != nil {
+			log.Fatalf("Error creating output directory: %v", err)
+		}
+	}
+	var sum hash.Hash
+	if *checksum {
+		sum = sha256.New()
+	}
+	chunks, err := splitFile(*inputFile, *outDir, limit, *keepHeader, sum)
+	if err != nil {
+		fatalf(exitCode(err), "Error: %v", err)
+	}
+	if *manifestFile != "" {
+		manifest := splitManifest{Source: *inputFile, Header: *keepHeader, Chunks: chunks}
+		if sum != nil {
+			manifest.SHA256 = hex.EncodeToString(sum.Sum(nil))
+		}
+		logger.Printf("Writing manifest to %s...\n", *manifestFile)
+		writeManifest(*manifestFile, manifest)
+	}
+	logger.Println("Done splitting.")
+}
+
+// splitManifest describes the chunks written by one split run.
+type splitManifest struct {
+	Source string `json:"source"`
+	// Header is set when every chunk starts with a copy of the input's header line.
+	Header bool            `json:"header"`
+	Chunks []manifestChunk `json:"chunks"`
+	// SHA256 is the hex digest of the input's bytes, line endings included (a
+	// .gz input is hashed decompressed), if -checksum was set.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// manifestChunk is one chunk of a splitManifest. Lines includes any header line.
+type manifestChunk struct {
+	File  string `json:"file"`
+	Lines int    `json:"lines"`
+	Bytes int64  `json:"bytes"`
+}
+
+// readManifest loads a manifest written by writeManifest, resolving its chunk
+// paths against the manifest's directory.
+func readManifest(manifestFile string) splitManifest {
+	data, err := os.ReadFile(manifestFile)
+	if err != nil {
+		fatalf(exitMissingInput, "Error reading manifest: %v", err)
+	}
+	var manifest splitManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		fatalf(exitBadFormat, "Error: %s is not a split manifest: %v", manifestFile, err)
+	}
+	dir := filepath.Dir(manifestFile)
+	for i, chunk := range manifest.Chunks {
+		if !filepath.IsAbs(chunk.File) {
+			manifest.Chunks[i].File = filepath.Join(dir, chunk.File)
+		}
+	}
+	return manifest
+}
+
+// writeManifest writes manifest as JSON, with chunk paths relative to the
+// manifest's directory so the chunks and manifest can be moved together.
+func writeManifest(manifestFile string, manifest splitManifest) {
+	dir := filepath.Dir(manifestFile)
+	for i, chunk := range manifest.Chunks {
+		if rel, err := filepath.Rel(dir, chunk.File); err == nil {
+			manifest.Chunks[i].File = rel
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Fatalf("Error encoding manifest: %v", err)
+	}
+	out, err := createOutput(manifestFile)
+	if err != nil {
+		fatalf(exitFailure, "Error creating manifest: %v", err)
+	}
+	if _, err := out.Write(append(data, '\n')); err != nil {
+		fatalf(exitFailure, "Error writing manifest: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		fatalf(exitFailure, "Error closing manifest: %v", err)
+	}
+}
+
+// chunkLimit bounds a split chunk by line count or, if bytes is set, by size.
+type chunkLimit struct {
+	lines int
+	bytes int64
+}
+
+// full reports whether a chunk holding lines lines and size bytes has no room
+// for a next line of length next. An empty chunk always takes the line, so a
+// single line longer than the byte limit gets a chunk of its own.
+func (l chunkLimit) full(lines int, size, next int64) bool {
+	if l.bytes > 0 {
+		return lines > 0 && size+next > l.bytes
+	}
+	return lines >= l.lines
+}
 
-	log.Printf("Splitting file %s into chunks of %d lines...\n", *inputFile, *linesPerChunk)
-	splitFile(*inputFile, *linesPerChunk)
-	log.Println("Done splitting.")
+// byteSize is a flag.Value for sizes such as 500000, 512K, 100M or 2G (binary units).
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B"), "I")
+	multiplier := int64(1)
+	if n := len(number); n > 0 {
+		switch number[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			number = number[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("expected a positive size like 512K or 100M, got %q", value)
+	}
+	*b = byteSize(n * multiplier)
+	return nil
 }
 
-func splitFile(filePath string, linesPerChunk int) {
-	file, err := os.Open(filePath)
+// splitFile writes the chunks of filePath as <base>_part_N.txt, in outDir if it
+// is set and next to filePath otherwise, and returns what it wrote. Lines are
+// copied with their own endings, so the chunks joined give back the input byte
+// for byte, and every byte read is also written to sum, unless it is nil.
+func splitFile(filePath, outDir string, limit chunkLimit, keepHeader bool, sum hash.Hash) ([]manifestChunk, error) {
+	file, err := openInput(filePath)
 	if err != nil {
-		log.Fatalf("Error opening input file: %v", err)
+		return nil, withExitCode(exitMissingInput, fmt.Errorf("opening input file: %w", err))
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	lineCount := 0
+	scanner := newLineScanner(file)
+	scanner.Split(scanRawLines)
 	fileCount := 1
 	var outFile *os.File
 	var writer *bufio.Writer
+	chunkLines := 0
+	var chunkBytes int64
+
+	base := strings.TrimSuffix(filePath, ".gz")
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	if outDir != "" {
+		base = filepath.Join(outDir, filepath.Base(base))
+	}
+
+	// The first chunk starts with the header exactly as read, the others with
+	// a copy ending the same way
+	rawHeader, header, headerEnd := "", "", ""
+	if keepHeader && scanner.Scan() {
+		rawHeader = scanner.Text()
+		header, headerEnd = strings.TrimPrefix(trimRawLine(rawHeader), "\uFEFF"), rawLineEnding(rawHeader)
+		if sum != nil {
+			io.WriteString(sum, rawHeader)
+		}
+	}
+	_, headerDim, numericHeader := parseHeader(header)
+	// A numeric header is written as if the chunk were full and fixed up when it
+	// isn't; in -bytes mode that is decided per chunk, so its digits are budgeted
+	headerCount := limit.lines
+	if limit.bytes > 0 {
+		headerCount = int(limit.bytes)
+	}
+	outFileName := ""
+	var chunks []manifestChunk
+
+	// closeChunk flushes and closes the active chunk, correcting a numeric
+	// header whose count doesn't match the lines actually written
+	closeChunk := func() error {
+		flushErr := writer.Flush()
+		outFile.Close()
+		writer = nil
+		if flushErr != nil {
+			return fmt.Errorf("writing %s: %w", outFileName, flushErr)
+		}
+		if numericHeader && chunkLines != headerCount {
+			if err := rewriteFirstLine(outFileName, fmt.Sprintf("%d %d%s", chunkLines, headerDim, headerEnd)); err != nil {
+				return err
+			}
+		}
+		info, err := os.Stat(outFileName)
+		if err != nil {
+			return fmt.Errorf("reading back %s: %w", outFileName, err)
+		}
+		lines := chunkLines
+		if keepHeader {
+			lines++
+		}
+		chunks = append(chunks, manifestChunk{File: outFileName, Lines: lines, Bytes: info.Size()})
+		return nil
+	}
 
-	base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	// The handler takes mu, which the loop holds while writing each line,
+	// so the active chunk always ends on a complete line
+	var mu sync.Mutex
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+	go func() {
+		sig, ok := <-interrupts
+		if !ok {
+			return
+		}
+		mu.Lock()
+		if writer != nil {
+			lines := chunkLines
+			// Exiting anyway, so a failure here only loses the partial chunk
+			closeChunk()
+			logger.Printf("Interrupted (%v): part %d (%s) is partial, with %d lines.\n", sig, fileCount-1, outFileName, lines)
+		}
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
 
 	for scanner.Scan() {
-		if lineCount%linesPerChunk == 0 {
-			if writer != nil {
-				writer.Flush()
-				outFile.Close()
+		mu.Lock()
+		line := scanner.Text()
+		if sum != nil {
+			io.WriteString(sum, line)
+		}
+		if writer != nil && limit.full(chunkLines, chunkBytes, int64(len(line))) {
+			if err := closeChunk(); err != nil {
+				mu.Unlock()
+				return chunks, err
 			}
-			outFileName := fmt.Sprintf("%s_part_%d.txt", base, fileCount)
+		}
+		if writer == nil {
+			outFileName = fmt.Sprintf("%s_part_%d.txt", base, fileCount)
 			outFile, err = os.Create(outFileName)
 			if err != nil {
-				log.Fatalf("Error creating output file %s: %v", outFileName, err)
+				mu.Unlock()
+				return chunks, withExitCode(exitFailure, fmt.Errorf("creating output file %s: %w", outFileName, err))
 			}
-			writer = bufio.NewWriter(outFile)
-			log.Printf("Creating %s...", outFileName)
+			writer = newOutputWriter(outFile)
+			logger.Printf("Creating %s...", outFileName)
+			firstChunk := fileCount == 1
 			fileCount++
+			chunkLines, chunkBytes = 0, 0
+			if numericHeader {
+				n, _ := writer.WriteString(fmt.Sprintf("%d %d%s", headerCount, headerDim, headerEnd))
+				chunkBytes += int64(n)
+			} else if keepHeader && firstChunk {
+				n, _ := writer.WriteString(rawHeader)
+				chunkBytes += int64(n)
+			} else if keepHeader {
+				n, _ := writer.WriteString(header + headerEnd)
+				chunkBytes += int64(n)
+			}
+		}
+		n, _ := writer.WriteString(line)
+		chunkBytes += int64(n)
+		chunkLines++
+		if err := flushPeriodically(writer, chunkLines); err != nil {
+			outFile.Close()
+			writer = nil
+			mu.Unlock()
+			return chunks, fmt.Errorf("writing %s: %w", outFileName, err)
 		}
-		writer.WriteString(scanner.Text() + "\n")
-		lineCount++
+		mu.Unlock()
 	}
+	scanErr := scanError(scanner, "input file")
 
+	mu.Lock()
+	defer mu.Unlock()
 	if writer != nil {
-		writer.Flush()
-		outFile.Close()
+		// The last chunk is complete, so closing it leaves a late interrupt nothing to flush
+		if err := closeChunk(); err != nil {
+			return chunks, err
+		}
 	}
+	return chunks, scanErr
 }
 
-// --- PRUNE SUBCOMMAND ---
-
-func runPrune(args []string) {
-	pruneCmd := flag.NewFlagSet("prune", flag.ExitOnError)
-	inputFile := pruneCmd.String("input", "", "Path to the full GloVe vector file.")
-	vocabFile := pruneCmd.String("vocab", "", "Path to the vault vocabulary file.")
-	outputFile := pruneCmd.String("output", "pruned_vectors.txt", "Path for the final pruned output file.")
-	threshold := pruneCmd.Float64("threshold", 0.0, "Similarity threshold for including neighbors (0 to 1).")
-	cap := pruneCmd.Int("cap", 100000, "Hard vocabulary cap for the final file.")
-	neighbors := pruneCmd.Int("neighbors", 5, "Number of closest neighbors to consider.")
-	pruneCmd.Parse(args)
-
-	if *inputFile == "" || *vocabFile == "" {
-		log.Fatal("Error: -input and -vocab flags are required for prune command.")
+// rewriteFirstLine replaces the first line of filePath with line, which carries
+// its own ending, and copies the rest byte for byte.
+func rewriteFirstLine(filePath, line string) error {
+	inFile, err := openInput(filePath)
+	if err != nil {
+		return withExitCode(exitFailure, fmt.Errorf("reopening %s: %w", filePath, err))
 	}
+	defer inFile.Close()
+	outFile, err := createOutput(filePath)
+	if err != nil {
+		return withExitCode(exitFailure, fmt.Errorf("rewriting %s: %w", filePath, err))
+	}
+	writer := bufio.NewWriter(outFile)
+	writer.WriteString(line)
+	scanner := newLineScanner(inFile)
+	scanner.Split(scanRawLines)
+	for first := true; scanner.Scan(); first = false {
+		if !first {
+			writer.WriteString(scanner.Text())
+		}
+	}
+	if err := scanError(scanner, filePath); err != nil {
+		abortOutput(outFile)
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		abortOutput(outFile)
+		return fmt.Errorf("rewriting %s: %w", filePath, err)
+	}
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("rewriting %s: %w", filePath, err)
+	}
+	return nil
+}
 
-	// The rest of the pruning logic is the same as before
-	log.Println("Loading full GloVe model...")
-	fullGloveMap := loadGloveModel(*inputFile)
-	log.Printf("-> Loaded %d total vectors.\n", len(fullGloveMap))
-
-	log.Println("Loading vault vocabulary...")
-	vaultVocab := loadVocabulary(*vocabFile)
-	log.Printf("-> Found %d unique words in vault.\n", len(vaultVocab))
-
-	log.Println("Finding neighbors for vault words...")
-	neighborVocab := findNeighborsConcurrently(vaultVocab, fullGloveMap, *neighbors, *threshold)
-	log.Printf("-> Found %d unique neighbors (after de-duplication).\n", len(neighborVocab))
+// --- JOIN SUBCOMMAND ---
 
-	// ... (rest of the pruning and writing logic is identical to the previous script) ...
-	// ... (I've included it here for completeness)
+func runJoin(args []string) {
+	joinCmd := flag.NewFlagSet("join", flag.ExitOnError)
+	base := joinCmd.String("input", "", "Base path of the chunks, i.e. everything before _part_N.txt.")
+	manifestFile := joinCmd.String("manifest", "", "Join the chunks listed in this split manifest instead of searching for -input's, checking the result against its SHA-256 if it has one.")
+	outputFile := joinCmd.String("output", "", "Path for the reassembled file.")
+	addCommonFlags(joinCmd)
+	joinCmd.Parse(args)
 
-	finalVocab := make(map[string]bool)
-	for word := range vaultVocab {
-		finalVocab[word] = true
+	if (*base == "") == (*manifestFile == "") || *outputFile == "" {
+		log.Fatal("Error: -output and one of -input or -manifest are required for join command.")
 	}
-	for word := range neighborVocab {
-		if !finalVocab[word] {
-			finalVocab[word] = true
+
+	var manifest splitManifest
+	var parts []chunkFile
+	if *manifestFile != "" {
+		manifest = readManifest(*manifestFile)
+		for i, chunk := range manifest.Chunks {
+			if _, err := os.Stat(chunk.File); err != nil {
+				fatalf(exitMissingInput, "Error: chunk %d of the manifest: %v", i+1, err)
+			}
+			parts = append(parts, chunkFile{path: chunk.File, number: i + 1})
 		}
-	}
-	log.Printf("Combined vocabulary size before pruning: %d words.\n", len(finalVocab))
-	if len(finalVocab) > *cap {
-		log.Printf("Size exceeds cap of %d. Pruning neighbors randomly...\n", *cap)
-		neighborsToKeep := *cap - len(vaultVocab)
-		if neighborsToKeep < 0 {
-			neighborsToKeep = 0
+		if len(parts) == 0 {
+			log.Fatalf("Error: %s lists no chunks.", *manifestFile)
 		}
-		neighborList := make([]string, 0, len(neighborVocab))
-		for word := range neighborVocab {
-			neighborList = append(neighborList, word)
+	} else if parts = findChunks(*base); len(parts) == 0 {
+		fatalf(exitMissingInput, "Error: no chunks matching %s_part_N.txt found.", *base)
+	}
+	for _, part := range parts {
+		if err := checkOutputPath(*outputFile, part.path); err != nil {
+			log.Fatalf("Error: %v", err)
 		}
-		rand.Seed(time.Now().UnixNano())
-		rand.Shuffle(len(neighborList), func(i, j int) {
-			neighborList[i], neighborList[j] = neighborList[j], neighborList[i]
-		})
-		finalVocab = make(map[string]bool)
-		for word := range vaultVocab {
-			finalVocab[word] = true
+	}
+	// split numbers chunks from 1 with no holes, so any gap means a lost file
+	expected := 1
+	for _, part := range parts {
+		for ; expected < part.number; expected++ {
+			logger.Printf("Warning: chunk %d is missing.\n", expected)
 		}
+		expected = part.number + 1
+	}
 
-		for i := 0; i < neighborsToKeep && i < len(neighborList); i++ {
-			finalVocab[neighborList[i]] = true
+	lineCount, firstLine, digest, err := joinChunks(*outputFile, parts, manifest.Header)
+	if err != nil {
+		fatalf(exitCode(err), "Error: %v", err)
+	}
+
+	// A "<count> <dim>" header records how many vectors should follow it
+	if count, _, ok := parseHeader(firstLine); ok {
+		if count != lineCount-1 {
+			logger.Printf("Warning: header records %d vectors but %d lines follow it.\n", count, lineCount-1)
+		} else {
+			logger.Printf("-> Line count matches the %d vectors recorded in the header.\n", count)
 		}
-		log.Printf("-> Pruned vocabulary down to %d total words.\n", len(finalVocab))
 	}
-	log.Printf("Writing final pruned file to %s...\n", *outputFile)
-	writePrunedFile(*inputFile, *outputFile, finalVocab)
-	log.Println("Done!")
+	logger.Printf("Joined %d chunks (%d lines) into %s.\n", len(parts), lineCount, *outputFile)
+	if manifest.SHA256 != "" {
+		if digest != manifest.SHA256 {
+			fatalf(exitBadFormat, "Error: checksum mismatch: %s has SHA-256 %s, but split recorded %s for %s. A chunk is missing or was modified.", *outputFile, digest, manifest.SHA256, manifest.Source)
+		}
+		logger.Println("-> SHA-256 matches the split input.")
+	}
 }
 
+// joinChunks concatenates parts into outputFile, dropping the header split
+// repeated in every chunk after the first (headerRepeated, from the manifest)
+// and collapsing the "<count> <dim>" headers of "split -header" chunks into one
+// carrying the total count. Lines are copied with their own endings, so an
+// edit that only changed them still changes digest, the hex SHA-256 of what
+// was written. It returns the lines written and the first of them too.
+func joinChunks(outputFile string, parts []chunkFile, headerRepeated bool) (lineCount int, firstLine, digest string, err error) {
+	chunkHeaders, headerDim := len(parts) > 1, -1
+	totalCount := 0
+	for _, part := range parts {
+		line, err := readFirstLine(part.path)
+		if err != nil {
+			return 0, "", "", err
+		}
+		count, dim, ok := parseHeader(line)
+		if !ok || (headerDim != -1 && dim != headerDim) {
+			chunkHeaders = false
+			break
+		}
+		headerDim = dim
+		totalCount += count
+	}
+	if chunkHeaders {
+		logger.Println("Every chunk starts with a header, merging them into one.")
+	}
 
-// --- SHARED HELPER FUNCTIONS ---
-
-func loadGloveModel(filePath string) map[string]Vector {
-	file, err := os.Open(filePath)
+	outFile, err := createOutput(outputFile)
 	if err != nil {
-		log.Fatalf("Error opening GloVe file: %v", err)
+		return 0, "", "", withExitCode(exitFailure, fmt.Errorf("creating output file: %w", err))
 	}
-	defer file.Close()
-	gloveMap := make(map[string]Vector)
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		parts := strings.Fields(scanner.Text())
-		word := parts[0]
-		vec := make(Vector, len(parts)-1)
-		for i, v := range parts[1:] {
-			vec[i], _ = strconv.ParseFloat(v, 64)
+	defer func() {
+		if err != nil {
+			abortOutput(outFile)
+		}
+	}()
+	// Hashing what is written, before any compression, is what split hashed too
+	sum := sha256.New()
+	writer := bufio.NewWriter(io.MultiWriter(outFile, sum))
+	for i, part := range parts {
+		logger.Printf("Appending %s...\n", part.path)
+		file, err := openInput(part.path)
+		if err != nil {
+			return 0, "", "", withExitCode(exitMissingInput, fmt.Errorf("opening chunk: %w", err))
+		}
+		repeatedHeader := chunkHeaders || (headerRepeated && part.number > 1)
+		scanner := newLineScanner(file)
+		scanner.Split(scanRawLines)
+		line := ""
+		for first := true; scanner.Scan(); first = false {
+			line = scanner.Text()
+			if first && repeatedHeader {
+				if !chunkHeaders || i > 0 {
+					continue
+				}
+				// The first chunk's header becomes the total, ending as it did
+				line = fmt.Sprintf("%d %d%s", totalCount, headerDim, rawLineEnding(line))
+			}
+			if lineCount == 0 {
+				firstLine = strings.TrimPrefix(trimRawLine(line), "\uFEFF")
+			}
+			writer.WriteString(line)
+			lineCount++
+		}
+		err = scanError(scanner, part.path)
+		file.Close()
+		if err != nil {
+			return 0, "", "", err
+		}
+		// A chunk edited to drop its final newline mustn't run into the next one
+		if i < len(parts)-1 && line != "" && !strings.HasSuffix(line, "\n") {
+			writer.WriteString("\n")
 		}
-		gloveMap[word] = vec
 	}
-	return gloveMap
+	if err := writer.Flush(); err != nil {
+		return 0, "", "", fmt.Errorf("writing output file: %w", err)
+	}
+	if err := outFile.Close(); err != nil {
+		return 0, "", "", fmt.Errorf("closing output file: %w", err)
+	}
+	return lineCount, firstLine, hex.EncodeToString(sum.Sum(nil)), nil
 }
 
-func loadVocabulary(filePath string) map[string]bool {
-	file, err := os.Open(filePath)
+// readFirstLine returns the first line of filePath, or "" if it is empty.
+func readFirstLine(filePath string) (string, error) {
+	file, err := openInput(filePath)
 	if err != nil {
-		log.Fatalf("Error opening vocabulary file: %v", err)
+		return "", withExitCode(exitMissingInput, fmt.Errorf("opening %s: %w", filePath, err))
 	}
 	defer file.Close()
-	vocab := make(map[string]bool)
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		vocab[strings.TrimSpace(scanner.Text())] = true
+	scanner := newLineScanner(file)
+	if scanner.Scan() {
+		return scanner.Text(), nil
 	}
-	return vocab
+	return "", scanError(scanner, filePath)
 }
 
-func cosineSimilarity(vecA, vecB Vector) float64 {
-	var dotProduct, normA, normB float64
-	for i := range vecA {
-		dotProduct += vecA[i] * vecB[i]
-		normA += vecA[i] * vecA[i]
-		normB += vecB[i] * vecB[i]
+// chunkFile is one _part_N.txt file produced by split.
+type chunkFile struct {
+	path   string
+	number int
+}
+
+// findChunks returns the split chunks for base, in numeric (not lexical) order.
+func findChunks(base string) []chunkFile {
+	matches, err := filepath.Glob(base + "_part_*.txt")
+	if err != nil {
+		log.Fatalf("Error listing chunks: %v", err)
 	}
-	if normA == 0 || normB == 0 {
-		return 0.0
+	var parts []chunkFile
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, base+"_part_"), ".txt")
+		n, err := strconv.Atoi(suffix)
+		if err != nil || n < 1 {
+			continue
+		}
+		parts = append(parts, chunkFile{path: match, number: n})
 	}
-	return dotProduct / (math.Sqrt(normA) * math.Sqrt(normB))
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].number < parts[j].number
+	})
+	return parts
 }
 
-func findNeighborsConcurrently(vaultVocab map[string]bool, fullGloveMap map[string]Vector, topN int, threshold float64) map[string]bool {
-	var wg sync.WaitGroup
-	var mutex sync.Mutex
-	neighborVocab := make(map[string]bool)
-	jobs := make(chan string, len(vaultVocab))
-	numWorkers := runtime.NumCPU()
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for vaultWord := range jobs {
-				vaultVec, ok := fullGloveMap[vaultWord]
-				if !ok {
-					continue
-				}
-				similarities := make([]Similarity, 0, len(fullGloveMap))
-				for gloveWord, gloveVec := range fullGloveMap {
-					if gloveWord != vaultWord {
-						sim := cosineSimilarity(vaultVec, gloveVec)
-						if sim >= threshold {
-							similarities = append(similarities, Similarity{Word: gloveWord, Score: sim})
-						}
-					}
-				}
-				sort.Slice(similarities, func(i, j int) bool {
-					return similarities[i].Score > similarities[j].Score
-				})
-				mutex.Lock()
-				for i := 0; i < topN && i < len(similarities); i++ {
-					neighborVocab[similarities[i].Word] = true
-				}
-				mutex.Unlock()
+// --- PRUNE SUBCOMMAND ---
+
+func runPrune(args []string) {
+	pruneCmd := flag.NewFlagSet("prune", flag.ExitOnError)
+	inputFile := pruneCmd.String("input", "", "Path to the full GloVe vector file (.gz files are decompressed on the fly, - reads stdin). A comma-separated list prunes against the union of several models.")
+	lastWins := pruneCmd.Bool("last-wins", false, "With several -input files, take a word's vector from the last file that has it instead of the first.")
+	vocabFile := pruneCmd.String("vocab", "", "Path to the vault vocabulary file (- reads stdin).")
+	outputFile := pruneCmd.String("output", "pruned_vectors.txt", "Path for the final pruned output file (a .gz suffix compresses it).")
+	threshold := pruneCmd.Float64("threshold", 0.0, "Score threshold for including neighbors: the minimum similarity for cosine and dot, the maximum distance for euclidean (0 means no limit).")
+	cap := pruneCmd.Int("cap", 100000, "Hard vocabulary cap for the final file.")
+	neighbors := pruneCmd.Int("neighbors", 5, "Number of closest neighbors to consider (0 skips the search and keeps only vault words).")
+	decay := pruneCmd.Bool("decay", false, "With vocabulary counts, give frequent vault words fewer neighbors: max(1, round(N / ln(count))) for counts above e, where N is -neighbors, so rare terms get the most expansion.")
+	mode := pruneCmd.String("mode", "per-word", "How -neighbors counts: 'per-word' keeps the closest N of every vault word, guaranteeing each one some coverage; 'global' keeps the closest N (vault word, neighbor) pairs across the whole vault, a total budget.")
+	metricName := pruneCmd.String("metric", "cosine", metricHelp)
+	workers := pruneCmd.Int("workers", 0, "Number of neighbor-search goroutines (0 uses every CPU).")
+	minNorm := pruneCmd.Float64("min-norm", 0, "Ignore model vectors whose L2 norm is below this value as neighbor candidates.")
+	seed := pruneCmd.Int64("seed", 42, "Seed for random neighbor trimming; setting it implies -random.")
+	random := pruneCmd.Bool("random", false, "Trim neighbors over the cap at random instead of keeping the ones closest to any vault word.")
+	excludeFile := pruneCmd.String("exclude", "", "Path to a file of words (one per line) to drop from the vault vocabulary.")
+	seedFile := pruneCmd.String("seed-words", "", "Path to a file of extra words (one per line) to always include in the output, regardless of threshold and cap.")
+	excludeFromOutput := pruneCmd.Bool("exclude-from-output", false, "Also drop -exclude words from the output when they turn up as neighbors.")
+	neighborReport := pruneCmd.String("neighbor-report", "", "Write a source_word,neighbor_word,score CSV of every neighbor found (before cap trimming) to this file.")
+	provenance := pruneCmd.String("provenance", "", "Write a word<TAB>source file telling, for every written word, whether it came from the vault, the -seed-words or the neighbor search.")
+	reportZero := pruneCmd.String("report-zero", "", "Write vault words whose model vector is all zeros, which get no neighbors, to this file (- for stderr).")
+	reportMissing := pruneCmd.String("report-missing", "", "Write vault words with no vector in the model to this file (- for stderr).")
+	lowercase := pruneCmd.Bool("lowercase", false, "Lowercase vault (and -exclude) words before matching them against the model.")
+	preserveCase := pruneCmd.Bool("preserve-case", false, "With -lowercase-model, copy output lines with the model's original casing instead of lowercasing the word.")
+	lowMem := pruneCmd.Bool("lowmem", false, "Stream the model in two passes instead of loading it into memory. Memory then scales with the vault instead of the model, at the cost of reading the input twice (three times for binary input).")
+	maxVocab := pruneCmd.Int("max-vocab", 1000000, "Fail if the vault vocabulary has more than this many distinct words, which usually means -vocab points at the wrong file (0 means no limit).")
+	minFreq := pruneCmd.Int("min-freq", 0, "With word<TAB>count vocabulary lines, drop vault words counted fewer than M times, such as one-off typos (words without a count are kept).")
+	filter := pruneCmd.String("filter", "", "Only keep vault words matching this Go regexp, e.g. '^[[:alpha:]]{2,}$' (matched after -lowercase).")
+	phrase := pruneCmd.Bool("phrase", false, "Search multi-word vault entries (\"machine learning\") with the average vector of their words; phrases with no known word are skipped.")
+	oov := pruneCmd.String("oov", "none", "How to handle vault words missing from the model: 'none' skips them, 'subword' searches with the average vector of their hyphen/underscore-separated parts.")
+	approx := pruneCmd.Int("approx", 0, "Approximate the neighbor search with N random-hyperplane hash tables (LSH), e.g. 16, only scoring model words that share a bucket with the vault word. Much faster on large models, but some true neighbors may be missed; more tables recall more of them at the cost of speed. Cosine only (0 searches exactly).")
+	adaptive := pruneCmd.Bool("adaptive", false, "Only keep neighbors scoring past mean + k*stddev of each vault word's scores against the whole model (k is -adaptive-k), so words in dense regions get a stricter floor. Can't be combined with -lowmem or -approx.")
+	adaptiveK := pruneCmd.Float64("adaptive-k", 2, "The k of -adaptive: how many standard deviations past the mean a neighbor must score.")
+	percentile := pruneCmd.Float64("percentile", 0, "Only keep neighbors scoring past this percentile (0-100) of each vault word's scores against the whole model, e.g. 99.9. Requires scoring every candidate, so it can't be combined with -lowmem.")
+	excludeNumeric := pruneCmd.Bool("exclude-numeric", false, "Never pick neighbors made only of digits, punctuation and symbols, such as '1999', '3.14' or '--'.")
+	minWordLen := pruneCmd.Int("min-word-len", 0, "Never pick neighbors shorter than this many characters (0 means no minimum).")
+	externalOnly := pruneCmd.Bool("neighbors-external-only", false, "Skip vault words as neighbor candidates, so neighbor slots (and the -neighbor-report) only hold words from outside the vault.")
+	minVotes := pruneCmd.Int("min-votes", 1, "Only keep neighbors that at least this many distinct vault words pull in.")
+	depth := pruneCmd.Int("depth", 1, "Hops of neighbors to collect: 2 also adds the neighbors of the vault words' neighbors, and so on. Each hop can multiply the vocabulary by -neighbors, so keep -cap in mind.")
+	neighborBudget := pruneCmd.Int("neighbor-budget", 0, "Add at most K neighbor words in total, keeping the ones closest to any vault word (0 means no limit). Applied before, and independently of, -cap.")
+	splitLines := pruneCmd.Int("split-lines", 0, "Also split the output into chunks of this many lines named after -output (<output>_part_N.txt), as the split command would (0 writes just the one file).")
+	cacheFile := pruneCmd.String("cache", "", "Path of a binary cache of the parsed model: written on the first run, then read instead of parsing -input while it is newer than the input and was built with the same load flags.")
+	dryRun := pruneCmd.Bool("dry-run", false, "Report the final vocabulary breakdown and estimated output size without writing any files.")
+	timing := pruneCmd.Bool("timing", false, "Print how long each phase (loading, neighbor search, trimming, writing) took.")
+	dim := pruneCmd.Int("dim", 0, "Keep only the first K dimensions of every output vector (0 keeps them all).")
+	keepOrder := pruneCmd.Bool("keep-order", false, "When the output is written from memory (several -input files, stdin or binary input), write words in the order they first appear across the models instead of alphabetically. A single text file is copied line by line, so it always keeps its order.")
+	sortOutput := pruneCmd.Bool("sort", false, "Write the output sorted by word instead of in model order, for stable diffs. Buffers every output line in memory, so streaming (the default) suits very large outputs better.")
+	appendVocab := pruneCmd.Bool("append-vocab", false, "Keep the existing -output file and only search neighbors for vault words it doesn't contain yet, appending their lines.")
+	loadOpts := addLoadFlags(pruneCmd)
+	addFormatFlags(pruneCmd)
+	addWriteFlags(pruneCmd)
+	addCommonFlags(pruneCmd)
+	addCommentFlag(pruneCmd)
+	pruneCmd.Parse(args)
+
+	metric, err := parseMetric(*metricName)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if outputPrecision < -1 {
+		log.Fatal("Error: -precision must be at least 0 (or -1 for full precision).")
+	}
+	if *oov != "none" && *oov != "subword" {
+		log.Fatalf("Error: unknown -oov mode %q (expected 'none' or 'subword').", *oov)
+	}
+	if *mode != "per-word" && *mode != "global" {
+		log.Fatalf("Error: unknown -mode %q (expected 'per-word' or 'global').", *mode)
+	}
+	if *minFreq < 0 {
+		log.Fatal("Error: -min-freq must be positive (or 0 to keep every word).")
+	}
+	if *minWordLen < 0 {
+		log.Fatal("Error: -min-word-len must be positive (or 0 for no minimum).")
+	}
+	if *maxVocab < 0 {
+		log.Fatal("Error: -max-vocab must be positive (or 0 for no limit).")
+	}
+	vocabOpts := vocabOptions{Lowercase: *lowercase, MinFreq: *minFreq, MaxWords: *maxVocab}
+	if *filter != "" {
+		if vocabOpts.Filter, err = regexp.Compile(*filter); err != nil {
+			log.Fatalf("Error: invalid -filter: %v", err)
+		}
+	}
+	pruneCmd.Visit(func(f *flag.Flag) {
+		if f.Name == "seed" {
+			*random = true
+		}
+	})
+	var inputs stringList
+	inputs.Set(*inputFile)
+
+	result, err := Prune(PruneOptions{
+		Inputs:            inputs,
+		LastWins:          *lastWins,
+		VocabFile:         *vocabFile,
+		OutputFile:        *outputFile,
+		Load:              loadOpts,
+		Vocab:             vocabOpts,
+		Search:            neighborOptions{TopN: *neighbors, Threshold: *threshold, Metric: metric, Workers: *workers, MinNorm: *minNorm, Subword: *oov == "subword", Phrase: *phrase, Percentile: *percentile, Approx: *approx, ExternalOnly: *externalOnly, ExcludeNumeric: *excludeNumeric, MinWordLen: *minWordLen, Adaptive: *adaptive, AdaptiveK: *adaptiveK},
+		Cap:               *cap,
+		Random:            *random,
+		Seed:              *seed,
+		ExcludeFile:       *excludeFile,
+		ExcludeFromOutput: *excludeFromOutput,
+		SeedFile:          *seedFile,
+		MinVotes:          *minVotes,
+		NeighborBudget:    *neighborBudget,
+		Depth:             *depth,
+		GlobalTopN:        *mode == "global",
+		DecayNeighbors:    *decay,
+		PreserveCase:      *preserveCase,
+		LowMem:            *lowMem,
+		AppendVocab:       *appendVocab,
+		KeepOrder:         *keepOrder,
+		Sort:              *sortOutput,
+		Dim:               *dim,
+		DryRun:            *dryRun,
+		CacheFile:         *cacheFile,
+		SplitLines:        *splitLines,
+	})
+	if err != nil {
+		fatalf(exitCode(err), "Error: %v", err)
+	}
+
+	if *neighborReport != "" && !*dryRun {
+		logger.Printf("Writing neighbor report to %s...\n", *neighborReport)
+		writeNeighborReport(*neighborReport, result.Neighbors)
+	}
+	if *provenance != "" && !*dryRun {
+		logger.Printf("Writing provenance to %s...\n", *provenance)
+		writeProvenance(*provenance, result.Sources)
+	}
+	if *dryRun {
+		if *appendVocab {
+			fmt.Printf("already in output:\t%d\n", result.Existing)
+		}
+		fmt.Printf("final vocabulary size:\t%d\n", len(result.Final))
+		fmt.Printf("from vault:\t%d (plus %d without a vector and %d built from their parts, not written)\n", result.FromVault, len(result.Missing), len(result.Composed))
+		if result.SeedWords > 0 {
+			fmt.Printf("from seed words:\t%d\n", result.FromSeeds)
+		}
+		fmt.Printf("from neighbors:\t%d\n", result.FromNeighbors)
+		if *neighborBudget > 0 {
+			fmt.Printf("trimmed by budget:\t%d\n", result.TrimmedByBudget)
+		}
+		fmt.Printf("trimmed by cap:\t%d\n", result.TrimmedByCap)
+		fmt.Printf("estimated output size:\t%s (uncompressed)\n", formatBytes(result.EstimatedBytes))
+	} else {
+		if len(result.Missing) > 0 {
+			logger.Printf("%d of %d vault words were not found in the model.\n", len(result.Missing), result.VaultWords)
+			if *reportMissing != "" {
+				writeWordList(*reportMissing, result.Missing)
 			}
-		}()
+		}
+		if len(result.ZeroVectors) > 0 && *reportZero != "" {
+			writeWordList(*reportZero, result.ZeroVectors)
+		}
 	}
-	for word := range vaultVocab {
-		jobs <- word
+	if *timing {
+		result.Timings.report()
 	}
-	close(jobs)
-	wg.Wait()
-	return neighborVocab
+	logger.Println("Done!")
 }
 
-func writePrunedFile(inputFile, outputFile string, finalVocab map[string]bool) {
-	inFile, err := os.Open(inputFile)
-	if err != nil {
-		log.Fatalf("Error opening GloVe file for writing: %v", err)
+// PruneOptions configures a Prune run. It holds parsed values, so any flag
+// syntax has already been checked by the caller.
+type PruneOptions struct {
+	// Inputs are the model files; several are merged (see readGloveModels).
+	Inputs     []string
+	LastWins   bool
+	VocabFile  string
+	OutputFile string
+	Load       *loadOptions
+	Vocab      vocabOptions
+	Search     neighborOptions
+	// Cap bounds the output vocabulary. Neighbors over it are dropped at random
+	// (seeded by Seed) with Random, and otherwise furthest first.
+	Cap    int
+	Random bool
+	Seed   int64
+	// ExcludeFile words are dropped from the vault, and with ExcludeFromOutput
+	// from the neighbors too. SeedFile words are always written.
+	ExcludeFile       string
+	ExcludeFromOutput bool
+	SeedFile          string
+	MinVotes          int
+	// NeighborBudget caps the neighbor words added on top of the vault and seed
+	// words, keeping the closest ones. It is applied before, and separately
+	// from, Cap; 0 means no budget.
+	NeighborBudget int
+	// Depth is how many hops of neighbors are collected: 2 also searches from
+	// the neighbors of the vault words, and so on. Hops past the first score a
+	// word against the neighbor that pulled it in, not against a vault word,
+	// and start from the neighbors left after MinVotes and the exclusions,
+	// which only ever count the vault words' own neighbors.
+	Depth int
+	// GlobalTopN makes Search.TopN count (vault word, neighbor) pairs across the
+	// whole vault instead of per vault word.
+	GlobalTopN bool
+	// DecayNeighbors shrinks each vault word's neighbor count with its vocabulary
+	// count (see decayedNeighbors); words without a count keep Search.TopN.
+	DecayNeighbors bool
+	PreserveCase   bool
+	LowMem         bool
+	AppendVocab    bool
+	// KeepOrder writes an output built in memory (several models, stdin or
+	// binary input) in first-seen model order rather than sorted; a single text
+	// model is copied line by line, so it always keeps its order.
+	KeepOrder bool
+	Dim       int
+	// Sort writes the output sorted by word. A single model is otherwise
+	// streamed in its own order, so this buffers every output line in memory.
+	Sort bool
+	// DryRun stops before writing and fills in PruneResult.EstimatedBytes instead.
+	DryRun bool
+	// SplitLines, if positive, also splits the output into <output>_part_N.txt
+	// chunks of that many lines, as the split subcommand does.
+	SplitLines int
+	// CacheFile, if set, is a binary copy of the parsed model (see
+	// loadModelCached) read instead of parsing a single text input again.
+	CacheFile string
+}
+
+// PruneResult describes what a Prune run selected.
+type PruneResult struct {
+	// VaultWords counts the vault words searched from, after exclusions and
+	// any words already present with AppendVocab (Existing of them).
+	VaultWords int
+	Existing   int
+	SeedWords  int
+	// Neighbors holds every neighbor found per vault word, before any trimming.
+	// HopNeighbors holds, with Depth above 1, those found per neighbor on the
+	// later hops.
+	Neighbors    map[string][]Similarity
+	HopNeighbors map[string][]Similarity
+	// Final is the written vocabulary (excluding Existing words), broken down
+	// by where each word came from; TrimmedByBudget and TrimmedByCap neighbors
+	// didn't make it.
+	Final           map[string]bool
+	FromVault       int
+	FromSeeds       int
+	FromNeighbors   int
+	TrimmedByBudget int
+	TrimmedByCap    int
+	// Sources tells, for each Final word, whether it is a "vault", "seed" or
+	// "neighbor" word.
+	Sources map[string]string
+	// Missing lists the vault words with no vector in the model, sorted.
+	Missing []string
+	// ZeroVectors lists the vault words whose vector is all zeros, sorted; they
+	// are written but have no neighbors.
+	ZeroVectors []string
+	// Composed lists the vault words searched from the average vector of their
+	// parts, sorted. Their neighbors are written, but they aren't, since the
+	// model has no line for them, so they aren't in Final or FromVault either.
+	Composed       []string
+	EstimatedBytes int64
+	// Chunks lists the files the output was split into with SplitLines.
+	Chunks  []manifestChunk
+	Timings *phaseTimer
+}
+
+// Prune selects the vault words of opts.VocabFile plus their closest neighbors
+// in the model and writes their vectors to opts.OutputFile. Every failure, from
+// invalid options to unreadable models and unwritable output, is returned as an
+// error carrying its exit code (see exitCode) rather than ending the program.
+func Prune(opts PruneOptions) (PruneResult, error) {
+	result := PruneResult{Timings: newPhaseTimer()}
+	timer := result.Timings
+	metric := opts.Search.Metric
+	if len(opts.Inputs) == 0 || opts.VocabFile == "" {
+		return result, errors.New("-input and -vocab flags are required for prune command")
 	}
-	defer inFile.Close()
-	outFile, err := os.Create(outputFile)
+	inputFile := opts.Inputs[0]
+	readsStdin := false
+	for _, input := range opts.Inputs {
+		readsStdin = readsStdin || input == "-"
+	}
+	switch {
+	case readsStdin && opts.VocabFile == "-":
+		return result, errors.New("only one of -input and -vocab can read from stdin")
+	case opts.LowMem && readsStdin:
+		return result, errors.New("-lowmem needs to read -input more than once, so it can't be stdin")
+	case opts.LowMem && len(opts.Inputs) > 1:
+		return result, errors.New("-lowmem streams a single model, so it can't be combined with several -input files")
+	case opts.Search.Workers < 0:
+		return result, errors.New("-workers must be at least 1 (or 0 for one per CPU)")
+	case opts.Search.Percentile < 0 || opts.Search.Percentile >= 100:
+		return result, errors.New("-percentile must be between 0 and 100")
+	case opts.Search.Approx < 0:
+		return result, errors.New("-approx must be positive (or 0 for an exact search)")
+	case opts.Search.Approx > 0 && opts.LowMem:
+		return result, errors.New("-approx keeps a hash index of the whole model in memory, so it can't be combined with -lowmem")
+	case opts.Search.Approx > 0 && opts.Search.Percentile > 0:
+		return result, errors.New("-percentile needs every score of each vault word, which -approx doesn't compute")
+	case opts.Search.Approx > 0 && metric.Name != "cosine":
+		return result, errors.New("-approx buckets vectors by direction, so it only supports -metric cosine")
+	case opts.Search.Percentile > 0 && opts.LowMem:
+		return result, errors.New("-percentile needs every score of each vault word, which -lowmem doesn't keep")
+	case opts.Search.Adaptive && opts.LowMem:
+		return result, errors.New("-adaptive needs every score of each vault word, which -lowmem doesn't keep")
+	case opts.Search.Adaptive && opts.Search.Approx > 0:
+		return result, errors.New("-adaptive needs every score of each vault word, which -approx doesn't compute")
+	case opts.MinVotes < 1:
+		return result, errors.New("-min-votes must be at least 1")
+	case opts.NeighborBudget < 0:
+		return result, errors.New("-neighbor-budget must be positive (or 0 for no limit)")
+	case opts.Depth < 1:
+		return result, errors.New("-depth must be at least 1")
+	case opts.Depth > 1 && opts.LowMem:
+		return result, errors.New("-depth searches again from the neighbors found, which needs the model -lowmem doesn't keep in memory")
+	case opts.SplitLines < 0:
+		return result, errors.New("-split-lines must be positive (or 0 to write a single file)")
+	case opts.Dim < 0:
+		return result, errors.New("-dim must be positive (or 0 to keep every dimension)")
+	case opts.Sort && opts.KeepOrder:
+		return result, errors.New("-sort and -keep-order ask for different output orders; use only one")
+	case opts.CacheFile != "" && (readsStdin || len(opts.Inputs) > 1 || isURL(inputFile)):
+		return result, errors.New("-cache can only stand in for a single local -input file, not stdin or a URL")
+	case strings.HasSuffix(opts.CacheFile, ".gz"):
+		return result, errors.New("-cache is read back as is to skip parsing, so it can't be a .gz file")
+	case opts.CacheFile != "" && opts.LowMem:
+		return result, errors.New("-cache holds the whole parsed model, which -lowmem never loads")
+	}
+	if err := checkOutputPath(opts.OutputFile, append([]string{opts.VocabFile, opts.ExcludeFile, opts.SeedFile}, opts.Inputs...)...); err != nil {
+		return result, err
+	}
+	if opts.Depth > 1 {
+		logger.Printf("Warning: -depth %d can multiply the neighbors by up to %d with every hop, so the vocabulary grows quickly; -cap still bounds the output.\n", opts.Depth, opts.Search.TopN)
+	}
+	if opts.Dim > 0 {
+		logger.Printf("Warning: -dim %d truncates the output vectors. Similarities computed from them will be less accurate, but the file shrinks roughly in proportion.\n", opts.Dim)
+	}
+	// Exclude and seed lists are folded like the vault but never filtered
+	listOpts := vocabOptions{Lowercase: opts.Vocab.Lowercase}
+
+	// The vocabulary is small, so load it first and fail fast on a bad path
+	logger.Println("Loading vault vocabulary...")
+	vaultVocab, vaultCounts, err := loadVocabulary(opts.VocabFile, opts.Vocab)
 	if err != nil {
-		log.Fatalf("Error creating output file: %v", err)
+		return result, err
 	}
-	defer outFile.Close()
-	writer := bufio.NewWriter(outFile)
-	scanner := bufio.NewScanner(inFile)
-	for scanner.Scan() {
-		line := scanner.Text()
-		word := strings.SplitN(line, " ", 2)[0]
-		if finalVocab[word] {
-			writer.WriteString(line + "\n")
+	logger.Printf("-> Found %d unique words in vault.\n", len(vaultVocab))
+	if len(vaultCounts) > 0 {
+		logger.Printf("-> %d of them have frequency counts, which take priority when trimming to the cap.\n", len(vaultCounts))
+	}
+
+	var excluded map[string]bool
+	if opts.ExcludeFile != "" {
+		if excluded, _, err = loadVocabulary(opts.ExcludeFile, listOpts); err != nil {
+			return result, err
+		}
+		removed := 0
+		for word := range excluded {
+			if vaultVocab[word] {
+				delete(vaultVocab, word)
+				removed++
+			}
 		}
+		logger.Printf("-> Excluded %d vault words (%d words in exclude list).\n", removed, len(excluded))
 	}
-	writer.Flush()
-}
\ No newline at end of file
+
+	// Seed words are always written but never searched from
+	seeds := make(map[string]bool)
+	if opts.SeedFile != "" {
+		if seeds, _, err = loadVocabulary(opts.SeedFile, listOpts); err != nil {
+			return result, err
+		}
+		for word := range vaultVocab {
+			delete(seeds, word)
+		}
+		logger.Printf("-> Force-including %d seed words beyond the vault.\n", len(seeds))
+	}
+
+	// Words already in the output are neither searched again nor written twice
+	var existing map[string]bool
+	if opts.AppendVocab {
+		if existing, err = existingOutputWords(opts.OutputFile, opts.Load.Lowercase); err != nil {
+			return result, err
+		}
+		present := 0
+		for word := range vaultVocab {
+			if existing[word] {
+				delete(vaultVocab, word)
+				present++
+			}
+		}
+		for word := range seeds {
+			if existing[word] {
+				delete(seeds, word)
+			}
+		}
+		logger.Printf("-> %s already has %d words, %d of them vault words; %d new vault words to add.\n", opts.OutputFile, len(existing), present, len(vaultVocab))
+		result.Existing = len(existing)
+		if len(vaultVocab) == 0 && len(seeds) == 0 {
+			logger.Println("Nothing to append.")
+			return result, nil
+		}
+	}
+	result.VaultWords, result.SeedWords = len(vaultVocab), len(seeds)
+	timer.mark("load vocabulary")
+
+	var fullGloveMap map[string]Vector
+	var modelOrder []string
+	var neighborsByWord map[string][]Similarity
+	var missing, zero, composed []string
+	if opts.Search.TopN == 0 {
+		// Nothing to search, so only the vault words' vectors are worth keeping
+		logger.Println("-neighbors is 0: skipping neighbor search and keeping just the vault words...")
+		wanted := vaultVocab
+		if len(seeds) > 0 {
+			wanted = make(map[string]bool, len(vaultVocab)+len(seeds))
+			for word := range vaultVocab {
+				wanted[word] = true
+			}
+			for word := range seeds {
+				wanted[word] = true
+			}
+		}
+		if fullGloveMap, modelOrder, err = readVaultVectors(opts.Inputs, opts.Load, opts.LastWins, wanted); err != nil {
+			return result, err
+		}
+		if len(fullGloveMap) > 0 {
+			if err := checkTruncation(opts.Dim, vectorDim(fullGloveMap)); err != nil {
+				return result, err
+			}
+		}
+		neighborsByWord = make(map[string][]Similarity)
+		for word := range vaultVocab {
+			if _, ok := fullGloveMap[word]; !ok {
+				missing = append(missing, word)
+			}
+		}
+		sort.Strings(missing)
+		logger.Printf("-> Found vectors for %d of %d vault words.\n", len(vaultVocab)-len(missing), len(vaultVocab))
+		timer.mark("load vault vectors")
+	} else if opts.LowMem {
+		logger.Println("Finding neighbors for vault words by streaming the model...")
+		if neighborsByWord, missing, zero, composed, err = findNeighborsStreaming(inputFile, opts.Load, vaultVocab, opts.Search); err != nil {
+			return result, err
+		}
+		timer.mark("neighbor search (streaming)")
+	} else {
+		logger.Println("Loading full GloVe model...")
+		if len(opts.Inputs) > 1 {
+			fullGloveMap, modelOrder, err = readGloveModels(opts.Inputs, opts.Load, opts.LastWins)
+		} else if opts.CacheFile != "" {
+			fullGloveMap, modelOrder, err = loadModelCached(inputFile, opts.CacheFile, opts.Load)
+		} else {
+			fullGloveMap, modelOrder, err = readGloveModelOrdered(inputFile, opts.Load)
+		}
+		if err != nil {
+			return result, err
+		}
+		logger.Printf("-> Loaded %d total vectors.\n", len(fullGloveMap))
+		if err := checkTruncation(opts.Dim, vectorDim(fullGloveMap)); err != nil {
+			return result, err
+		}
+		timer.mark("load model")
+
+		logger.Println("Finding neighbors for vault words...")
+		neighborsByWord, missing, zero, composed = findNeighborsConcurrently(vaultVocab, fullGloveMap, opts.Search)
+		timer.mark("neighbor search")
+	}
+	if len(vaultVocab) > 0 && len(missing) == len(vaultVocab) {
+		return result, withExitCode(exitNoMatches, fmt.Errorf("none of the %d vault words has a vector in the model (check -lowercase and the vocabulary format)", len(vaultVocab)))
+	}
+	if len(zero) > 0 {
+		// They are still written: they are in the model, just degenerate
+		logger.Printf("Warning: skipped the neighbor search for %d vault words with all-zero vectors: %s\n", len(zero), summarizeWords(zero, 10))
+	}
+	result.ZeroVectors = zero
+	if opts.DecayNeighbors {
+		if len(vaultCounts) == 0 {
+			logger.Println("Warning: -decay needs word<TAB>count vocabulary lines; every vault word keeps all its neighbors.")
+		}
+		dropped := 0
+		for word, similarities := range neighborsByWord {
+			if n := decayedNeighbors(opts.Search.TopN, vaultCounts[word]); n < len(similarities) {
+				dropped += len(similarities) - n
+				neighborsByWord[word] = similarities[:n]
+			}
+		}
+		logger.Printf("-> Frequency decay dropped %d neighbors of common vault words.\n", dropped)
+	}
+	if opts.GlobalTopN {
+		before := 0
+		for _, similarities := range neighborsByWord {
+			before += len(similarities)
+		}
+		// A vault word can't place more pairs in the global top N than its own
+		// top N, so the per-word search above already found every candidate
+		neighborsByWord = globalTopPairs(neighborsByWord, opts.Search.TopN, metric)
+		logger.Printf("-> Kept the %d closest of %d (vault word, neighbor) pairs across the vault.\n", opts.Search.TopN, before)
+	}
+	result.Neighbors, result.Missing = neighborsByWord, missing
+	neighborVocab := bestScores(neighborsByWord, metric)
+	logger.Printf("-> Found %d unique neighbors (after de-duplication).\n", len(neighborVocab))
+	if opts.ExcludeFromOutput {
+		removed := 0
+		for word := range excluded {
+			if _, ok := neighborVocab[word]; ok {
+				delete(neighborVocab, word)
+				removed++
+			}
+		}
+		logger.Printf("-> Dropped %d excluded words from the neighbors.\n", removed)
+	}
+	for word := range existing {
+		delete(neighborVocab, word)
+	}
+	if opts.MinVotes > 1 {
+		votes := neighborVotes(neighborsByWord)
+		removed := 0
+		for word := range neighborVocab {
+			if votes[word] < opts.MinVotes {
+				delete(neighborVocab, word)
+				removed++
+			}
+		}
+		logger.Printf("-> Dropped %d neighbors pulled in by fewer than %d vault words; %d remain.\n", removed, opts.MinVotes, len(neighborVocab))
+	}
+	if opts.Depth > 1 && fullGloveMap != nil {
+		// Each further hop searches from the new words the previous one kept.
+		// Its neighbors stay out of neighborsByWord, so votes, -decay and the
+		// neighbor report only ever count vault words.
+		hopSearch := opts.Search
+		hopSearch.vault = vaultVocab
+		result.HopNeighbors = make(map[string][]Similarity)
+		frontier := make(map[string]bool, len(neighborVocab))
+		for word := range neighborVocab {
+			if !vaultVocab[word] {
+				frontier[word] = true
+			}
+		}
+		for depth := 2; depth <= opts.Depth && len(frontier) > 0; depth++ {
+			logger.Printf("Finding neighbors for %d new words at depth %d...\n", len(frontier), depth)
+			round, _, _, _ := findNeighborsConcurrently(frontier, fullGloveMap, hopSearch)
+			for word, similarities := range round {
+				result.HopNeighbors[word] = similarities
+			}
+			frontier = make(map[string]bool)
+			for word, score := range bestScores(round, metric) {
+				if vaultVocab[word] || existing[word] || (opts.ExcludeFromOutput && excluded[word]) {
+					continue
+				}
+				if best, ok := neighborVocab[word]; !ok || metric.closer(score, best) {
+					neighborVocab[word] = score
+				}
+				if _, searched := result.HopNeighbors[word]; !searched {
+					frontier[word] = true
+				}
+			}
+		}
+		logger.Printf("-> %d unique neighbors after %d hops.\n", len(neighborVocab), opts.Depth)
+		timer.mark("neighbor hops")
+	}
+	if opts.NeighborBudget > 0 {
+		// Neighbors that are vault or seed words are written anyway, so they
+		// don't spend the budget
+		added := make([]string, 0, len(neighborVocab))
+		for word := range neighborVocab {
+			if !vaultVocab[word] && !seeds[word] {
+				added = append(added, word)
+			}
+		}
+		if len(added) > opts.NeighborBudget {
+			sort.Strings(added)
+			sort.SliceStable(added, func(i, j int) bool {
+				return metric.closer(neighborVocab[added[i]], neighborVocab[added[j]])
+			})
+			for _, word := range added[opts.NeighborBudget:] {
+				delete(neighborVocab, word)
+			}
+			result.TrimmedByBudget = len(added) - opts.NeighborBudget
+			logger.Printf("-> Kept the %d closest of %d added neighbors (-neighbor-budget).\n", opts.NeighborBudget, len(added))
+		}
+	}
+
+	// A vault word whose model lines were all rejected (bad numbers or the
+	// wrong dimension) is missing too, and must not have a line copied. One
+	// searched with a vector built from its parts has no line to copy either.
+	vaultFound := make(map[string]bool, len(vaultVocab))
+	for word := range vaultVocab {
+		vaultFound[word] = true
+	}
+	for _, word := range missing {
+		delete(vaultFound, word)
+	}
+	for _, word := range composed {
+		delete(vaultFound, word)
+	}
+	result.Composed = composed
+	finalVocab := make(map[string]bool)
+	for word := range vaultFound {
+		finalVocab[word] = true
+	}
+	for word := range seeds {
+		finalVocab[word] = true
+	}
+	// Vault and seed words are always written, so only the neighbors added on
+	// top of them compete for what the cap leaves
+	fixed := len(finalVocab)
+	for word := range neighborVocab {
+		if !finalVocab[word] {
+			finalVocab[word] = true
+		}
+	}
+	logger.Printf("Combined vocabulary size before pruning: %d words.\n", len(finalVocab)+len(existing))
+	if len(finalVocab)+len(existing) > opts.Cap {
+		neighborsToKeep := opts.Cap - fixed - len(existing)
+		if neighborsToKeep < 0 {
+			neighborsToKeep = 0
+		}
+		neighborList := make([]string, 0, len(neighborVocab))
+		for word := range neighborVocab {
+			if !vaultVocab[word] && !seeds[word] {
+				neighborList = append(neighborList, word)
+			}
+		}
+		// Sort first so both strategies are reproducible regardless of map order
+		sort.Strings(neighborList)
+		if opts.Random {
+			logger.Printf("Size exceeds cap of %d. Pruning neighbors randomly (seed %d)...\n", opts.Cap, opts.Seed)
+			rng := rand.New(rand.NewSource(opts.Seed))
+			rng.Shuffle(len(neighborList), func(i, j int) {
+				neighborList[i], neighborList[j] = neighborList[j], neighborList[i]
+			})
+		} else if len(vaultCounts) > 0 {
+			logger.Printf("Size exceeds cap of %d. Keeping the neighbors of the most frequent vault words first...\n", opts.Cap)
+			weights := neighborWeights(neighborsByWord, vaultCounts)
+			sort.SliceStable(neighborList, func(i, j int) bool {
+				a, b := neighborList[i], neighborList[j]
+				if weights[a] != weights[b] {
+					return weights[a] > weights[b]
+				}
+				return metric.closer(neighborVocab[a], neighborVocab[b])
+			})
+		} else {
+			logger.Printf("Size exceeds cap of %d. Keeping the neighbors closest to any vault word...\n", opts.Cap)
+			sort.SliceStable(neighborList, func(i, j int) bool {
+				return metric.closer(neighborVocab[neighborList[i]], neighborVocab[neighborList[j]])
+			})
+		}
+		finalVocab = make(map[string]bool)
+		for word := range vaultFound {
+			finalVocab[word] = true
+		}
+		for word := range seeds {
+			finalVocab[word] = true
+		}
+		for i := 0; i < neighborsToKeep && i < len(neighborList); i++ {
+			finalVocab[neighborList[i]] = true
+		}
+		logger.Printf("-> Pruned vocabulary down to %d total words.\n", len(finalVocab)+len(existing))
+	}
+	timer.mark("combine and trim")
+
+	candidates := 0
+	for word := range neighborVocab {
+		if !vaultVocab[word] && !seeds[word] {
+			candidates++
+		}
+	}
+	result.Sources = make(map[string]string, len(finalVocab))
+	for word := range finalVocab {
+		switch {
+		case vaultVocab[word]:
+			result.FromVault++
+			result.Sources[word] = "vault"
+		case seeds[word]:
+			result.FromSeeds++
+			result.Sources[word] = "seed"
+		default:
+			result.FromNeighbors++
+			result.Sources[word] = "neighbor"
+		}
+	}
+	result.Final, result.TrimmedByCap = finalVocab, candidates-result.FromNeighbors
+	if opts.DryRun {
+		logger.Println("Dry run: estimating the output size without writing it...")
+		if result.EstimatedBytes, err = estimateOutputSize(inputFile, opts.Load, fullGloveMap, finalVocab, opts.Dim); err != nil {
+			return result, err
+		}
+		timer.mark("estimate size")
+		return result, nil
+	}
+
+	writeTarget := opts.OutputFile
+	if opts.AppendVocab {
+		// The new lines go to a side file first so the output is replaced in one step
+		tmp, err := os.CreateTemp(filepath.Dir(opts.OutputFile), "."+filepath.Base(opts.OutputFile)+".append-*")
+		if err != nil {
+			return result, withExitCode(exitFailure, fmt.Errorf("creating temporary file: %w", err))
+		}
+		tmp.Close()
+		writeTarget = tmp.Name()
+		defer os.Remove(writeTarget)
+		logger.Printf("Appending %d words to %s...\n", len(finalVocab), opts.OutputFile)
+	} else {
+		logger.Printf("Writing final pruned file to %s...\n", opts.OutputFile)
+	}
+	if readsStdin || len(opts.Inputs) > 1 || opts.Load.isBinary(inputFile) {
+		// Stdin can't be re-read, binary input has no lines to copy and several
+		// inputs have no single file to copy from, so write the kept vectors
+		// from memory instead
+		if fullGloveMap == nil {
+			fullGloveMap = make(map[string]Vector, len(finalVocab))
+			err := readVectors(inputFile, opts.Load, func(word string, vec Vector) {
+				if finalVocab[word] {
+					if _, seen := fullGloveMap[word]; !seen {
+						modelOrder = append(modelOrder, word)
+					}
+					fullGloveMap[word] = vec
+				}
+			})
+			if err != nil {
+				return result, err
+			}
+		}
+		keptWords := make([]string, 0, len(finalVocab))
+		if opts.KeepOrder {
+			for _, word := range modelOrder {
+				if finalVocab[word] {
+					keptWords = append(keptWords, word)
+				}
+			}
+		} else {
+			for word := range finalVocab {
+				if _, ok := fullGloveMap[word]; ok {
+					keptWords = append(keptWords, word)
+				}
+			}
+			sort.Strings(keptWords)
+		}
+		if opts.Dim > 0 {
+			if err := checkTruncation(opts.Dim, vectorDim(fullGloveMap)); err != nil {
+				return result, err
+			}
+			for _, word := range keptWords {
+				fullGloveMap[word] = fullGloveMap[word][:opts.Dim]
+			}
+		}
+		if err := writeVectorFile(writeTarget, keptWords, fullGloveMap); err != nil {
+			return result, err
+		}
+	} else {
+		if opts.Sort {
+			logger.Printf("Warning: -sort holds all %d output lines in memory before writing them; leave it off to stream very large outputs.\n", len(finalVocab))
+		}
+		if err := writePrunedFile(inputFile, writeTarget, finalVocab, opts.Load, opts.PreserveCase, opts.Dim, opts.Sort); err != nil {
+			return result, err
+		}
+	}
+	if opts.AppendVocab {
+		if err := appendLines(opts.OutputFile, writeTarget); err != nil {
+			return result, err
+		}
+	}
+	timer.mark("write output")
+	if opts.SplitLines > 0 {
+		logger.Printf("Splitting %s into chunks of %d lines...\n", opts.OutputFile, opts.SplitLines)
+		if result.Chunks, err = splitFile(opts.OutputFile, "", chunkLimit{lines: opts.SplitLines}, false, nil); err != nil {
+			return result, err
+		}
+		logger.Printf("-> Wrote %d chunks.\n", len(result.Chunks))
+		timer.mark("split output")
+	}
+	return result, nil
+}
+
+// --- QUERY SUBCOMMAND ---
+
+func runQuery(args []string) {
+	queryCmd := flag.NewFlagSet("query", flag.ExitOnError)
+	inputFile := queryCmd.String("input", "", "Path to the GloVe vector file (- reads stdin).")
+	var words stringList
+	queryCmd.Var(&words, "word", "Word to query. Repeat the flag or use a comma-separated list for several words.")
+	topN := queryCmd.Int("topn", 10, "Number of nearest neighbors to print per word.")
+	metricName := queryCmd.String("metric", "cosine", metricHelp)
+	format := queryCmd.String("format", "text", "Output format: 'text' (word<TAB>score lines), 'json' (one JSON array per queried word, one per line) or 'md' (a markdown table per queried word, scores rounded to -precision digits or 6).")
+	prefix := queryCmd.String("prefix", "", "Only rank model words starting with this prefix, e.g. 'neuro' for words like the query that start with it.")
+	raw := queryCmd.Bool("raw", false, "Print each word's own vector (as a GloVe text line, or a JSON array with -format json) instead of its neighbors.")
+	loadOpts := addLoadFlags(queryCmd)
+	addFormatFlags(queryCmd)
+	addCommonFlags(queryCmd)
+	queryCmd.Parse(args)
+
+	if *inputFile == "" || len(words) == 0 {
+		log.Fatal("Error: -input and -word flags are required for query command.")
+	}
+	if *topN < 1 {
+		log.Fatal("Error: -topn must be at least 1.")
+	}
+	metric, err := parseMetric(*metricName)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if *format != "text" && *format != "json" && *format != "md" {
+		log.Fatalf("Error: unknown -format %q (expected 'text', 'json' or 'md').", *format)
+	}
+	if *raw && *format == "md" {
+		log.Fatal("Error: -raw prints vectors, which only -format text and json support.")
+	}
+	if *raw && *prefix != "" {
+		log.Fatal("Error: -prefix narrows down neighbors, which -raw doesn't print.")
+	}
+
+	var gloveMap map[string]Vector
+	if *raw {
+		// Nothing is ranked, so only the queried words need keeping
+		wanted := make(map[string]bool, len(words))
+		for _, word := range words {
+			wanted[word] = true
+		}
+		logger.Println("Loading GloVe model...")
+		gloveMap = loadVaultVectors([]string{*inputFile}, loadOpts, false, wanted)
+	} else {
+		logger.Println("Loading GloVe model...")
+		gloveMap = loadGloveModel(*inputFile, loadOpts)
+		logger.Printf("-> Loaded %d total vectors.\n", len(gloveMap))
+	}
+
+	// Check every word up front so we don't print partial results before failing
+	for _, word := range words {
+		if _, ok := gloveMap[word]; !ok {
+			fatalf(exitNoMatches, "Error: word %q not found in model.", word)
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	if *raw {
+		for _, word := range words {
+			if *format == "json" {
+				if err := encoder.Encode(gloveMap[word]); err != nil {
+					log.Fatalf("Error encoding results: %v", err)
+				}
+				continue
+			}
+			fmt.Println(formatVector(word, gloveMap[word]))
+		}
+		return
+	}
+	norms := vectorNorms(gloveMap)
+	// Filtering once up front spares every query from scoring the other words
+	candidates := gloveMap
+	if *prefix != "" {
+		candidates = make(map[string]Vector)
+		for word, vec := range gloveMap {
+			if strings.HasPrefix(word, *prefix) {
+				candidates[word] = vec
+			}
+		}
+		logger.Printf("-> %d model words start with %q.\n", len(candidates), *prefix)
+	}
+	for i, word := range words {
+		exclude := map[string]bool{word: true}
+		similarities := rankNeighbors(gloveMap[word], candidates, norms, exclude, *topN, metric)
+		if *format == "json" {
+			// encoding/json writes the shortest representation that round-trips
+			if err := encoder.Encode(similarities); err != nil {
+				log.Fatalf("Error encoding results: %v", err)
+			}
+			continue
+		}
+		if *format == "md" {
+			if i > 0 {
+				fmt.Println()
+			}
+			if len(words) > 1 {
+				fmt.Printf("## %s\n\n", markdownEscape(word))
+			}
+			writeMarkdownTable(os.Stdout, similarities)
+			continue
+		}
+		if len(words) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("# %s\n", word)
+		}
+		for _, sim := range similarities {
+			fmt.Printf("%s\t%.6f\n", sim.Word, sim.Score)
+		}
+	}
+}
+
+// writeMarkdownTable writes similarities as a "| word | score |" markdown table,
+// rounding scores to -precision digits (6 if it wasn't given).
+func writeMarkdownTable(w io.Writer, similarities []Similarity) {
+	precision := outputPrecision
+	if precision < 0 {
+		precision = 6
+	}
+	fmt.Fprintln(w, "| word | score |")
+	fmt.Fprintln(w, "| --- | ---: |")
+	for _, sim := range similarities {
+		fmt.Fprintf(w, "| %s | %s |\n", markdownEscape(sim.Word), strconv.FormatFloat(sim.Score, 'f', precision, 64))
+	}
+}
+
+// markdownEscape escapes the pipes that would otherwise split a table cell.
+func markdownEscape(text string) string {
+	return strings.ReplaceAll(text, "|", "\\|")
+}
+
+// --- INTRA SUBCOMMAND ---
+
+func runIntra(args []string) {
+	intraCmd := flag.NewFlagSet("intra", flag.ExitOnError)
+	inputFile := intraCmd.String("input", "", "Path to the GloVe vector file (- reads stdin).")
+	vocabFile := intraCmd.String("vocab", "", "Path to the vault vocabulary file.")
+	outputFile := intraCmd.String("output", "-", "Path for the word1<TAB>word2<TAB>score edge list (- for stdout).")
+	neighbors := intraCmd.Int("neighbors", 5, "Number of closest other vault words to link each vault word to.")
+	threshold := intraCmd.Float64("threshold", 0.0, "Score threshold for an edge: the minimum similarity for cosine and dot, the maximum distance for euclidean (0 means no limit).")
+	metricName := intraCmd.String("metric", "cosine", metricHelp)
+	lowercase := intraCmd.Bool("lowercase", false, "Lowercase vault words before matching them against the model.")
+	loadOpts := addLoadFlags(intraCmd)
+	addCommonFlags(intraCmd)
+	addCommentFlag(intraCmd)
+	intraCmd.Parse(args)
+
+	if *inputFile == "" || *vocabFile == "" {
+		log.Fatal("Error: -input and -vocab flags are required for intra command.")
+	}
+	if *neighbors < 1 {
+		log.Fatal("Error: -neighbors must be at least 1.")
+	}
+	if err := checkOutputPath(*outputFile, *inputFile, *vocabFile); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	metric, err := parseMetric(*metricName)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	logger.Println("Loading vault vocabulary...")
+	vaultVocab, _, err := loadVocabulary(*vocabFile, vocabOptions{Lowercase: *lowercase})
+	if err != nil {
+		fatalf(exitCode(err), "Error: %v", err)
+	}
+	// Only vault words are ever compared, so the rest of the model isn't kept
+	vaultVectors := loadVaultVectors([]string{*inputFile}, loadOpts, false, vaultVocab)
+	logger.Printf("-> Found vectors for %d of %d vault words.\n", len(vaultVectors), len(vaultVocab))
+	norms := vectorNorms(vaultVectors)
+
+	words := make([]string, 0, len(vaultVectors))
+	for word := range vaultVectors {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+
+	var out io.WriteCloser = nopWriteCloser{os.Stdout}
+	if *outputFile != "-" {
+		if out, err = createOutput(*outputFile); err != nil {
+			fatalf(exitFailure, "Error creating output file: %v", err)
+		}
+	}
+	writer := bufio.NewWriter(out)
+	edges := 0
+	for _, word := range words {
+		exclude := map[string]bool{word: true}
+		for _, sim := range rankNeighbors(vaultVectors[word], vaultVectors, norms, exclude, *neighbors, metric) {
+			if metric.passes(sim.Score, *threshold) {
+				fmt.Fprintf(writer, "%s\t%s\t%.6f\n", word, sim.Word, sim.Score)
+				edges++
+			}
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		fatalf(exitFailure, "Error writing output file: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		fatalf(exitFailure, "Error closing output file: %v", err)
+	}
+	logger.Printf("-> Wrote %d edges between %d vault words.\n", edges, len(words))
+}
+
+// --- MATRIX SUBCOMMAND ---
+
+// matrixWarnWords is the vault size from which matrix warns about the output it
+// is about to write: N words mean N² scores.
+const matrixWarnWords = 2000
+
+func runMatrix(args []string) {
+	matrixCmd := flag.NewFlagSet("matrix", flag.ExitOnError)
+	inputFile := matrixCmd.String("input", "", "Path to the GloVe vector file (- reads stdin).")
+	vocabFile := matrixCmd.String("vocab", "", "Path to the vault vocabulary file.")
+	outputFile := matrixCmd.String("output", "-", "Path for the CSV output (- for stdout).")
+	threshold := matrixCmd.Float64("threshold", 0.0, "Write a sparse word1,word2,score list of the pairs passing this threshold instead of the full matrix: the minimum similarity for cosine and dot, the maximum distance for euclidean (0 writes the full matrix).")
+	metricName := matrixCmd.String("metric", "cosine", metricHelp)
+	lowercase := matrixCmd.Bool("lowercase", false, "Lowercase vault words before matching them against the model.")
+	loadOpts := addLoadFlags(matrixCmd)
+	addCommonFlags(matrixCmd)
+	addCommentFlag(matrixCmd)
+	matrixCmd.Parse(args)
+
+	if *inputFile == "" || *vocabFile == "" {
+		log.Fatal("Error: -input and -vocab flags are required for matrix command.")
+	}
+	if err := checkOutputPath(*outputFile, *inputFile, *vocabFile); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	metric, err := parseMetric(*metricName)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	logger.Println("Loading vault vocabulary...")
+	vaultVocab, _, err := loadVocabulary(*vocabFile, vocabOptions{Lowercase: *lowercase})
+	if err != nil {
+		fatalf(exitCode(err), "Error: %v", err)
+	}
+	vaultVectors := loadVaultVectors([]string{*inputFile}, loadOpts, false, vaultVocab)
+	logger.Printf("-> Found vectors for %d of %d vault words.\n", len(vaultVectors), len(vaultVocab))
+	norms := vectorNorms(vaultVectors)
+	words := make([]string, 0, len(vaultVectors))
+	for word := range vaultVectors {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	sparse := *threshold != 0
+	if n := len(words); n >= matrixWarnWords {
+		if sparse {
+			logger.Printf("Warning: %d vault words mean %d pairs to score; only those passing -threshold are written.\n", n, n*(n-1)/2)
+		} else {
+			// Each cell is a comma plus a 0.123456-style score
+			logger.Printf("Warning: a %dx%d matrix is roughly %s of CSV. Use -threshold for a sparse list instead.\n", n, n, formatBytes(int64(n)*int64(n)*10))
+		}
+	}
+
+	var out io.WriteCloser = nopWriteCloser{os.Stdout}
+	if *outputFile != "-" {
+		if out, err = createOutput(*outputFile); err != nil {
+			fatalf(exitFailure, "Error creating output file: %v", err)
+		}
+	}
+	// Rows are scored and written one at a time, so memory stays at the vault's vectors
+	writer := csv.NewWriter(out)
+	score := func(a, b string) float64 {
+		return metric.Score(vaultVectors[a], vaultVectors[b], norms[a], norms[b])
+	}
+	progress := newProgress("matrix rows written:", len(words)/20, len(words))
+	written := 0
+	if sparse {
+		writer.Write([]string{"word1", "word2", "score"})
+		for i, a := range words {
+			for _, b := range words[i+1:] {
+				if sim := score(a, b); metric.passes(sim, *threshold) {
+					writer.Write([]string{a, b, strconv.FormatFloat(sim, 'f', 6, 64)})
+					written++
+				}
+			}
+			progress.tick()
+		}
+	} else {
+		writer.Write(append([]string{""}, words...))
+		row := make([]string, len(words)+1)
+		for _, a := range words {
+			row[0] = a
+			for j, b := range words {
+				row[j+1] = strconv.FormatFloat(score(a, b), 'f', 6, 64)
+			}
+			writer.Write(row)
+			written++
+			progress.tick()
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		fatalf(exitFailure, "Error writing output file: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		fatalf(exitFailure, "Error closing output file: %v", err)
+	}
+	if sparse {
+		logger.Printf("-> Wrote %d pairs among %d vault words.\n", written, len(words))
+	} else {
+		logger.Printf("-> Wrote a %dx%d matrix.\n", written, written)
+	}
+}
+
+// --- DELTA SUBCOMMAND ---
+
+func runDelta(args []string) {
+	deltaCmd := flag.NewFlagSet("delta", flag.ExitOnError)
+	inputFile := deltaCmd.String("input", "", "Path to the GloVe vector file (- reads stdin).")
+	vocabFile := deltaCmd.String("vocab", "", "Path to the vault vocabulary file.")
+	outputFile := deltaCmd.String("output", "-", "Path for the vaultword neighborword dim0 dim1 ... lines (- for stdout).")
+	neighbors := deltaCmd.Int("neighbors", 1, "Number of nearest neighbors per vault word to write a difference vector for.")
+	metricName := deltaCmd.String("metric", "cosine", metricHelp)
+	workers := deltaCmd.Int("workers", 0, "Number of neighbor-search goroutines (0 uses every CPU).")
+	lowercase := deltaCmd.Bool("lowercase", false, "Lowercase vault words before matching them against the model.")
+	loadOpts := addLoadFlags(deltaCmd)
+	addFormatFlags(deltaCmd)
+	addCommonFlags(deltaCmd)
+	addCommentFlag(deltaCmd)
+	deltaCmd.Parse(args)
+
+	if *inputFile == "" || *vocabFile == "" {
+		log.Fatal("Error: -input and -vocab flags are required for delta command.")
+	}
+	if *neighbors < 1 {
+		log.Fatal("Error: -neighbors must be at least 1.")
+	}
+	if err := checkOutputPath(*outputFile, *inputFile, *vocabFile); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	metric, err := parseMetric(*metricName)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	logger.Println("Loading vault vocabulary...")
+	vaultVocab, _, err := loadVocabulary(*vocabFile, vocabOptions{Lowercase: *lowercase})
+	if err != nil {
+		fatalf(exitCode(err), "Error: %v", err)
+	}
+	logger.Println("Loading GloVe model...")
+	gloveMap := loadGloveModel(*inputFile, loadOpts)
+	logger.Printf("-> Loaded %d total vectors.\n", len(gloveMap))
+
+	logger.Println("Finding neighbors for vault words...")
+	neighborsByWord, missing, zero, _ := findNeighborsConcurrently(vaultVocab, gloveMap, neighborOptions{TopN: *neighbors, Metric: metric, Workers: *workers})
+	if len(zero) > 0 {
+		logger.Printf("Warning: %d vault words have all-zero vectors and no meaningful neighbors: %s\n", len(zero), summarizeWords(zero, 10))
+	}
+	if len(vaultVocab) > 0 && len(missing) == len(vaultVocab) {
+		fatalf(exitNoMatches, "Error: none of the %d vault words has a vector in the model.", len(vaultVocab))
+	}
+	vaultWords := make([]string, 0, len(neighborsByWord))
+	for word := range neighborsByWord {
+		vaultWords = append(vaultWords, word)
+	}
+	sort.Strings(vaultWords)
+
+	var out io.WriteCloser = nopWriteCloser{os.Stdout}
+	if *outputFile != "-" {
+		if out, err = createOutput(*outputFile); err != nil {
+			fatalf(exitFailure, "Error creating output file: %v", err)
+		}
+	}
+	writer := bufio.NewWriter(out)
+	written := 0
+	for _, vaultWord := range vaultWords {
+		vaultVec := gloveMap[vaultWord]
+		for _, sim := range neighborsByWord[vaultWord] {
+			neighborVec := gloveMap[sim.Word]
+			delta := make(Vector, len(vaultVec))
+			for i := range delta {
+				delta[i] = vaultVec[i] - neighborVec[i]
+			}
+			writer.WriteString(formatVector(vaultWord+outputDelimiter+sim.Word, delta) + "\n")
+			written++
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		fatalf(exitFailure, "Error writing output file: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		fatalf(exitFailure, "Error closing output file: %v", err)
+	}
+	logger.Printf("-> Wrote %d difference vectors for %d vault words (%d missing from the model).\n", written, len(vaultWords), len(missing))
+}
+
+// --- SERVE SUBCOMMAND ---
+
+func runServe(args []string) {
+	serveCmd := flag.NewFlagSet("serve", flag.ExitOnError)
+	inputFile := serveCmd.String("input", "", "Path to the GloVe vector file (- reads stdin).")
+	host := serveCmd.String("host", "127.0.0.1", "Address to listen on. Keep it local unless you mean to expose the model.")
+	port := serveCmd.Int("port", 8080, "Port to listen on.")
+	metricName := serveCmd.String("metric", "cosine", metricHelp)
+	loadOpts := addLoadFlags(serveCmd)
+	addCommonFlags(serveCmd)
+	serveCmd.Parse(args)
+
+	if *inputFile == "" {
+		log.Fatal("Error: -input flag is required for serve command.")
+	}
+	metric, err := parseMetric(*metricName)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	logger.Println("Loading GloVe model...")
+	gloveMap := loadGloveModel(*inputFile, loadOpts)
+	norms := vectorNorms(gloveMap)
+	dim := vectorDim(gloveMap)
+	logger.Printf("-> Loaded %d total vectors.\n", len(gloveMap))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "vocab_size": len(gloveMap), "dimension": dim})
+	})
+	mux.HandleFunc("/neighbors", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "only GET is supported"})
+			return
+		}
+		word := r.URL.Query().Get("word")
+		if word == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing word parameter"})
+			return
+		}
+		topN := 10
+		if raw := r.URL.Query().Get("topn"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "topn must be a positive integer"})
+				return
+			}
+			topN = n
+		}
+		vec, ok := gloveMap[word]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("word %q not found in model", word)})
+			return
+		}
+		writeJSON(w, http.StatusOK, rankNeighbors(vec, gloveMap, norms, map[string]bool{word: true}, topN, metric))
+	})
+
+	addr := net.JoinHostPort(*host, strconv.Itoa(*port))
+	logger.Printf("Serving neighbor queries on http://%s (GET /neighbors?word=...&topn=..., GET /health)\n", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Printf("Error writing response: %v", err)
+	}
+}
+
+// --- MERGE SUBCOMMAND ---
+
+func runMerge(args []string) {
+	mergeCmd := flag.NewFlagSet("merge", flag.ExitOnError)
+	var inputFiles stringList
+	mergeCmd.Var(&inputFiles, "inputs", "Comma-separated list of vector files to merge. A file may carry a weight for -dedup average, e.g. domain.txt:3,glove.txt:1 (the default weight is 1).")
+	outputFile := mergeCmd.String("output", "merged_vectors.txt", "Path for the merged output file.")
+	dedup := mergeCmd.String("dedup", "first", "How to resolve words present in several inputs: 'first' or 'average' (weighted by the -inputs weights; implied when any are given).")
+	keepOrder := mergeCmd.Bool("keep-order", false, "Write words in the order they first appear across the inputs instead of alphabetically.")
+	loadOpts := addLoadFlags(mergeCmd)
+	addFormatFlags(mergeCmd)
+	addCommonFlags(mergeCmd)
+	mergeCmd.Parse(args)
+
+	if len(inputFiles) == 0 {
+		log.Fatal("Error: -inputs flag is required for merge command.")
+	}
+	if *dedup != "first" && *dedup != "average" {
+		log.Fatalf("Error: unknown -dedup strategy %q (expected 'first' or 'average').", *dedup)
+	}
+	paths := make([]string, len(inputFiles))
+	weights := make([]float64, len(inputFiles))
+	weighted := false
+	for i, input := range inputFiles {
+		path, weight, explicit, err := parseWeightedInput(input)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		paths[i], weights[i] = path, weight
+		weighted = weighted || explicit
+	}
+	if weighted {
+		dedupSet := false
+		mergeCmd.Visit(func(f *flag.Flag) {
+			dedupSet = dedupSet || f.Name == "dedup"
+		})
+		if dedupSet && *dedup != "average" {
+			log.Fatal("Error: -inputs weights only apply to -dedup average.")
+		}
+		*dedup = "average"
+	}
+	if err := checkOutputPath(*outputFile, paths...); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	merged := make(map[string]Vector)
+	counts := make(map[string]int)
+	// weightSums[word] is the total weight of the sources averaged into merged[word]
+	weightSums := make(map[string]float64)
+	var order []string
+	dim := -1
+	for fileIndex, inputFile := range paths {
+		weight := weights[fileIndex]
+		logger.Printf("Loading %s...\n", inputFile)
+		gloveMap, fileOrder := loadGloveModelOrdered(inputFile, loadOpts)
+		logger.Printf("-> Loaded %d vectors.\n", len(gloveMap))
+		if len(gloveMap) == 0 {
+			continue
+		}
+		fileDim := vectorDim(gloveMap)
+		if dim == -1 {
+			dim = fileDim
+		} else if fileDim != dim {
+			fatalf(exitBadFormat, "Error: %s has %d dimensions but earlier inputs have %d.", inputFile, fileDim, dim)
+		}
+		for _, word := range fileOrder {
+			vec := gloveMap[word]
+			existing, seen := merged[word]
+			switch {
+			case !seen:
+				merged[word] = vec
+				weightSums[word] = weight
+				order = append(order, word)
+			case *dedup == "average":
+				// Words found only once keep their vector untouched, so the
+				// first source is only scaled by its weight once a second turns up
+				if counts[word] == 1 {
+					for i := range existing {
+						existing[i] *= weightSums[word]
+					}
+				}
+				for i := range existing {
+					existing[i] += weight * vec[i]
+				}
+				weightSums[word] += weight
+			}
+			counts[word]++
+		}
+	}
+
+	duplicates := 0
+	for word, count := range counts {
+		if count < 2 {
+			continue
+		}
+		duplicates++
+		if *dedup == "average" {
+			vec := merged[word]
+			for i := range vec {
+				vec[i] /= weightSums[word]
+			}
+		}
+	}
+	logger.Printf("Merged %d unique words (%d present in more than one input).\n", len(merged), duplicates)
+
+	logger.Printf("Writing merged file to %s...\n", *outputFile)
+	words := order
+	if !*keepOrder {
+		// Sorted, like multi-input prune, so repeated runs still match byte for byte
+		words = make([]string, 0, len(merged))
+		for word := range merged {
+			words = append(words, word)
+		}
+		sort.Strings(words)
+	}
+	if err := writeVectorFile(*outputFile, words, merged); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	logger.Println("Done!")
+}
+
+// parseWeightedInput splits a merge input like "domain.txt:3" into its path and
+// weight. Without a numeric ":weight" suffix the whole item is the path and the
+// weight is 1; explicit reports whether a weight was given.
+func parseWeightedInput(item string) (path string, weight float64, explicit bool, err error) {
+	i := strings.LastIndexByte(item, ':')
+	if i < 0 {
+		return item, 1, false, nil
+	}
+	weight, err = strconv.ParseFloat(item[i+1:], 64)
+	if err != nil {
+		// A colon that isn't followed by a number belongs to the path
+		return item, 1, false, nil
+	}
+	if !(weight > 0) || math.IsInf(weight, 0) {
+		return "", 0, false, fmt.Errorf("weight of %s must be a positive number, got %s", item[:i], item[i+1:])
+	}
+	return item[:i], weight, true, nil
+}
+
+// --- DEDUP SUBCOMMAND ---
+
+func runDedup(args []string) {
+	dedupCmd := flag.NewFlagSet("dedup", flag.ExitOnError)
+	inputFile := dedupCmd.String("input", "", "Path to the vector file with repeated words.")
+	outputFile := dedupCmd.String("output", "deduped_vectors.txt", "Path for the deduplicated output file.")
+	strategy := dedupCmd.String("strategy", "first", "Which entry to keep for a repeated word: 'first', 'last' or 'average' (the average is written where the last entry was).")
+	loadOpts := addLoadFlags(dedupCmd)
+	addFormatFlags(dedupCmd)
+	addCommonFlags(dedupCmd)
+	dedupCmd.Parse(args)
+
+	if *inputFile == "" {
+		log.Fatal("Error: -input flag is required for dedup command.")
+	}
+	if err := checkOutputPath(*outputFile, *inputFile); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if *strategy != "first" && *strategy != "last" && *strategy != "average" {
+		log.Fatalf("Error: unknown -strategy %q (expected 'first', 'last' or 'average').", *strategy)
+	}
+	if *strategy != "first" && *inputFile == "-" {
+		log.Fatalf("Error: -strategy %s reads the input twice, so it can't be stdin.", *strategy)
+	}
+
+	// 'last' and 'average' need to know up front how often each word occurs
+	var occurrences map[string]int
+	if *strategy != "first" {
+		logger.Println("Counting word occurrences...")
+		occurrences = make(map[string]int)
+		streamVectors(*inputFile, loadOpts, func(word string, vec Vector) {
+			occurrences[word]++
+		})
+	}
+
+	outFile, err := createOutput(*outputFile)
+	if err != nil {
+		fatalf(exitFailure, "Error creating output file: %v", err)
+	}
+	writer := bufio.NewWriter(outFile)
+	// Entries are read as every other command reads the model, so they are
+	// written back from their vectors rather than copied
+	write := func(word string, vec Vector) {
+		line := formatVector(word, vec)
+		if loadOpts.TabWord {
+			// Keep the tab that lets a multi-word entry be read back
+			line = word + "\t" + line[len(word)+len(outputDelimiter):]
+		}
+		writer.WriteString(line + "\n")
+	}
+	seen := make(map[string]int)
+	sums := make(map[string]Vector)
+	collapsed := 0
+	logger.Printf("Writing deduplicated file to %s...\n", *outputFile)
+	// The loader holds every vector to the first one's dimension, so the
+	// entries of a word always add up
+	streamVectors(*inputFile, loadOpts, func(word string, vec Vector) {
+		seen[word]++
+		n := seen[word]
+		if n > 1 {
+			collapsed++
+		}
+		switch *strategy {
+		case "first":
+			if n == 1 {
+				write(word, vec)
+			}
+		case "last":
+			if n == occurrences[word] {
+				write(word, vec)
+			}
+		case "average":
+			total := occurrences[word]
+			if total == 1 {
+				write(word, vec)
+				return
+			}
+			if sum, ok := sums[word]; !ok {
+				sums[word] = append(Vector(nil), vec...)
+			} else {
+				for i := range sum {
+					sum[i] += vec[i]
+				}
+			}
+			if n == total {
+				sum := sums[word]
+				for i := range sum {
+					sum[i] /= float64(total)
+				}
+				write(word, sum)
+				delete(sums, word)
+			}
+		}
+	})
+	if err := writer.Flush(); err != nil {
+		fatalf(exitFailure, "Error writing output file: %v", err)
+	}
+	if err := outFile.Close(); err != nil {
+		fatalf(exitFailure, "Error closing output file: %v", err)
+	}
+	logger.Printf("-> Collapsed %d duplicate entries, %d unique words remain.\n", collapsed, len(seen))
+}
+
+// forEachLine calls fn for every non-blank line of filePath.
+func forEachLine(filePath string, fn func(line string)) {
+	if err := readLines(filePath, fn); err != nil {
+		fatalf(exitCode(err), "Error: %v", err)
+	}
+}
+
+// readLines is forEachLine for callers that return errors instead of exiting.
+func readLines(filePath string, fn func(line string)) error {
+	file, err := openInput(filePath)
+	if err != nil {
+		return withExitCode(exitMissingInput, fmt.Errorf("opening input file: %w", err))
+	}
+	defer file.Close()
+	scanner := newLineScanner(file)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.TrimSpace(line) != "" {
+			fn(line)
+		}
+	}
+	return scanError(scanner, filePath)
+}
+
+// --- STATS SUBCOMMAND ---
+
+func runStats(args []string) {
+	statsCmd := flag.NewFlagSet("stats", flag.ExitOnError)
+	inputFile := statsCmd.String("input", "", "Path to the GloVe vector file (- reads stdin).")
+	loadOpts := addLoadFlags(statsCmd)
+	addCommonFlags(statsCmd)
+	statsCmd.Parse(args)
+
+	if *inputFile == "" {
+		log.Fatal("Error: -input flag is required for stats command.")
+	}
+
+	logger.Println("Loading GloVe model...")
+	gloveMap := loadGloveModel(*inputFile, loadOpts)
+	if len(gloveMap) == 0 {
+		fatalf(exitBadFormat, "Error: no vectors found in input file.")
+	}
+
+	minNorm, maxNorm, sumNorm := math.Inf(1), 0.0, 0.0
+	zeroVectors, unitVectors := 0, 0
+	for _, vec := range gloveMap {
+		norm := l2Norm(vec)
+		if norm == 0 {
+			zeroVectors++
+		} else if math.Abs(norm-1) < 1e-6 {
+			unitVectors++
+		}
+		minNorm = math.Min(minNorm, norm)
+		maxNorm = math.Max(maxNorm, norm)
+		sumNorm += norm
+	}
+
+	fmt.Printf("vocabulary size:\t%d\n", len(gloveMap))
+	fmt.Printf("dimension:\t%d\n", vectorDim(gloveMap))
+	fmt.Printf("min L2 norm:\t%.6f\n", minNorm)
+	fmt.Printf("max L2 norm:\t%.6f\n", maxNorm)
+	fmt.Printf("mean L2 norm:\t%.6f\n", sumNorm/float64(len(gloveMap)))
+	fmt.Printf("zero vectors:\t%d\n", zeroVectors)
+	// Zero vectors stay zero under normalization, so they don't count against it
+	if unitVectors > 0 && unitVectors+zeroVectors == len(gloveMap) {
+		fmt.Println("note:\tvectors look L2-normalized, so cosine and dot rank neighbors identically")
+	}
+}
+
+// --- DIFF SUBCOMMAND ---
+
+func runDiff(args []string) {
+	diffCmd := flag.NewFlagSet("diff", flag.ExitOnError)
+	fileA := diffCmd.String("a", "", "Path to the first (old) vector file.")
+	fileB := diffCmd.String("b", "", "Path to the second (new) vector file.")
+	tolerance := diffCmd.Float64("tolerance", -1, "Also report shared words whose vectors differ by more than this in any component (0 reports any difference; negative skips the comparison).")
+	list := diffCmd.Bool("list", false, "Print the words behind each count: '< word' only in -a, '> word' only in -b, '~ word<TAB>max difference' changed.")
+	loadOpts := addLoadFlags(diffCmd)
+	addCommonFlags(diffCmd)
+	diffCmd.Parse(args)
+
+	if *fileA == "" || *fileB == "" {
+		log.Fatal("Error: -a and -b flags are required for diff command.")
+	}
+	if *fileA == "-" && *fileB == "-" {
+		log.Fatal("Error: only one of -a and -b can read from stdin.")
+	}
+
+	logger.Printf("Loading %s...\n", *fileA)
+	vectorsA := loadGloveModel(*fileA, loadOpts)
+	logger.Printf("Loading %s...\n", *fileB)
+	vectorsB := loadGloveModel(*fileB, loadOpts)
+
+	var onlyA, onlyB, changed []string
+	// maxDiffs holds the largest component difference of each changed word,
+	// or +Inf when the dimensions differ
+	maxDiffs := make(map[string]float64)
+	shared := 0
+	for word, vecA := range vectorsA {
+		vecB, ok := vectorsB[word]
+		if !ok {
+			onlyA = append(onlyA, word)
+			continue
+		}
+		shared++
+		if *tolerance < 0 {
+			continue
+		}
+		diff := math.Inf(1)
+		if len(vecA) == len(vecB) {
+			diff = 0
+			for i := range vecA {
+				diff = math.Max(diff, math.Abs(vecA[i]-vecB[i]))
+			}
+		}
+		if diff > *tolerance {
+			changed = append(changed, word)
+			maxDiffs[word] = diff
+		}
+	}
+	for word := range vectorsB {
+		if _, ok := vectorsA[word]; !ok {
+			onlyB = append(onlyB, word)
+		}
+	}
+	sort.Strings(onlyA)
+	sort.Strings(onlyB)
+	sort.Strings(changed)
+
+	fmt.Printf("words in a:\t%d\n", len(vectorsA))
+	fmt.Printf("words in b:\t%d\n", len(vectorsB))
+	fmt.Printf("shared:\t%d\n", shared)
+	fmt.Printf("only in a:\t%d\n", len(onlyA))
+	fmt.Printf("only in b:\t%d\n", len(onlyB))
+	if *tolerance >= 0 {
+		fmt.Printf("changed (> %g):\t%d\n", *tolerance, len(changed))
+	}
+	if *list {
+		for _, word := range onlyA {
+			fmt.Printf("< %s\n", word)
+		}
+		for _, word := range onlyB {
+			fmt.Printf("> %s\n", word)
+		}
+		for _, word := range changed {
+			if diff := maxDiffs[word]; math.IsInf(diff, 1) {
+				fmt.Printf("~ %s\tdimension %d vs %d\n", word, len(vectorsA[word]), len(vectorsB[word]))
+			} else {
+				fmt.Printf("~ %s\t%g\n", word, diff)
+			}
+		}
+	}
+}
+
+// --- VOCAB-INTERSECT SUBCOMMAND ---
+
+func runVocabIntersect(args []string) {
+	intersectCmd := flag.NewFlagSet("vocab-intersect", flag.ExitOnError)
+	fileA := intersectCmd.String("a", "", "Path to the first vocabulary file.")
+	fileB := intersectCmd.String("b", "", "Path to the second vocabulary file.")
+	lowercase := intersectCmd.Bool("lowercase", false, "Lowercase both vocabularies before comparing them.")
+	list := intersectCmd.Bool("list", false, "Print the words behind each count: '= word' in both, '< word' only in -a, '> word' only in -b.")
+	set := intersectCmd.String("set", "", "Write one set to -output, one word per line: 'intersection', 'union', 'only-a' or 'only-b'.")
+	outputFile := intersectCmd.String("output", "", "Path for the -set word list, which can be used as a -vocab file.")
+	addCommonFlags(intersectCmd)
+	addCommentFlag(intersectCmd)
+	intersectCmd.Parse(args)
+
+	if *fileA == "" || *fileB == "" {
+		log.Fatal("Error: -a and -b flags are required for vocab-intersect command.")
+	}
+	if *fileA == "-" && *fileB == "-" {
+		log.Fatal("Error: only one of -a and -b can read from stdin.")
+	}
+	switch *set {
+	case "", "intersection", "union", "only-a", "only-b":
+	default:
+		log.Fatalf("Error: unknown -set %q (expected 'intersection', 'union', 'only-a' or 'only-b').", *set)
+	}
+	if (*set == "") != (*outputFile == "") {
+		log.Fatal("Error: -set and -output must be given together.")
+	}
+	if err := checkOutputPath(*outputFile, *fileA, *fileB); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	opts := vocabOptions{Lowercase: *lowercase}
+	vocabA, _, err := loadVocabulary(*fileA, opts)
+	if err != nil {
+		fatalf(exitCode(err), "Error: %v", err)
+	}
+	vocabB, _, err := loadVocabulary(*fileB, opts)
+	if err != nil {
+		fatalf(exitCode(err), "Error: %v", err)
+	}
+
+	var shared, onlyA, onlyB []string
+	for word := range vocabA {
+		if vocabB[word] {
+			shared = append(shared, word)
+		} else {
+			onlyA = append(onlyA, word)
+		}
+	}
+	for word := range vocabB {
+		if !vocabA[word] {
+			onlyB = append(onlyB, word)
+		}
+	}
+	sort.Strings(shared)
+	sort.Strings(onlyA)
+	sort.Strings(onlyB)
+
+	fmt.Printf("words in a:\t%d\n", len(vocabA))
+	fmt.Printf("words in b:\t%d\n", len(vocabB))
+	fmt.Printf("intersection:\t%d\n", len(shared))
+	fmt.Printf("union:\t%d\n", len(shared)+len(onlyA)+len(onlyB))
+	fmt.Printf("only in a:\t%d\n", len(onlyA))
+	fmt.Printf("only in b:\t%d\n", len(onlyB))
+	if *list {
+		for _, word := range shared {
+			fmt.Printf("= %s\n", word)
+		}
+		for _, word := range onlyA {
+			fmt.Printf("< %s\n", word)
+		}
+		for _, word := range onlyB {
+			fmt.Printf("> %s\n", word)
+		}
+	}
+
+	var words []string
+	switch *set {
+	case "":
+		return
+	case "intersection":
+		words = shared
+	case "union":
+		words = append(append(append(words, shared...), onlyA...), onlyB...)
+		sort.Strings(words)
+	case "only-a":
+		words = onlyA
+	case "only-b":
+		words = onlyB
+	}
+	writeWordList(*outputFile, words)
+	logger.Printf("-> Wrote %d words (%s) to %s.\n", len(words), *set, *outputFile)
+}
+
+// --- NORMALIZE SUBCOMMAND ---
+
+func runNormalize(args []string) {
+	normalizeCmd := flag.NewFlagSet("normalize", flag.ExitOnError)
+	inputFile := normalizeCmd.String("input", "", "Path to the GloVe vector file (- reads stdin).")
+	outputFile := normalizeCmd.String("output", "normalized_vectors.txt", "Path for the L2-normalized output file.")
+	loadOpts := addLoadFlags(normalizeCmd)
+	addFormatFlags(normalizeCmd)
+	addCommonFlags(normalizeCmd)
+	normalizeCmd.Parse(args)
+
+	if *inputFile == "" {
+		log.Fatal("Error: -input flag is required for normalize command.")
+	}
+	if err := checkOutputPath(*outputFile, *inputFile); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	outFile, err := createOutput(*outputFile)
+	if err != nil {
+		fatalf(exitFailure, "Error creating output file: %v", err)
+	}
+	writer := bufio.NewWriter(outFile)
+
+	// Stream rather than load into a map so the output keeps the input's word order
+	logger.Printf("Normalizing %s into %s...\n", *inputFile, *outputFile)
+	written, zeroVectors := 0, 0
+	streamVectors(*inputFile, loadOpts, func(word string, vec Vector) {
+		if norm := l2Norm(vec); norm == 0 {
+			zeroVectors++
+		} else {
+			for i := range vec {
+				vec[i] /= norm
+			}
+		}
+		writer.WriteString(formatVector(word, vec) + "\n")
+		written++
+	})
+	if err := writer.Flush(); err != nil {
+		fatalf(exitFailure, "Error writing output file: %v", err)
+	}
+	if err := outFile.Close(); err != nil {
+		fatalf(exitFailure, "Error closing output file: %v", err)
+	}
+	logger.Printf("-> Wrote %d vectors (%d zero vectors left untouched).\n", written, zeroVectors)
+	logger.Println("Done!")
+}
+
+// --- TRUNCATE SUBCOMMAND ---
+
+func runTruncate(args []string) {
+	truncateCmd := flag.NewFlagSet("truncate", flag.ExitOnError)
+	inputFile := truncateCmd.String("input", "", "Path to the GloVe vector file (- reads stdin).")
+	outputFile := truncateCmd.String("output", "truncated_vectors.txt", "Path for the truncated output file.")
+	dim := truncateCmd.Int("dim", 0, "Number of leading dimensions to keep.")
+	loadOpts := addLoadFlags(truncateCmd)
+	addFormatFlags(truncateCmd)
+	addCommonFlags(truncateCmd)
+	truncateCmd.Parse(args)
+
+	if *inputFile == "" || *dim <= 0 {
+		log.Fatal("Error: -input and a positive -dim are required for truncate command.")
+	}
+	if err := checkOutputPath(*outputFile, *inputFile); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	logger.Printf("Warning: keeping %d dimensions degrades similarity quality, but shrinks the file roughly in proportion.\n", *dim)
+
+	outFile, err := createOutput(*outputFile)
+	if err != nil {
+		fatalf(exitFailure, "Error creating output file: %v", err)
+	}
+	writer := bufio.NewWriter(outFile)
+
+	logger.Printf("Truncating %s into %s...\n", *inputFile, *outputFile)
+	written := 0
+	streamVectors(*inputFile, loadOpts, func(word string, vec Vector) {
+		if written == 0 {
+			if err := checkTruncation(*dim, len(vec)); err != nil {
+				fatalf(exitFailure, "Error: %v", err)
+			}
+			logger.Printf("-> Reducing vectors from %d to %d dimensions.\n", len(vec), *dim)
+		}
+		writer.WriteString(formatVector(word, vec[:*dim]) + "\n")
+		written++
+	})
+	if err := writer.Flush(); err != nil {
+		fatalf(exitFailure, "Error writing output file: %v", err)
+	}
+	if err := outFile.Close(); err != nil {
+		fatalf(exitFailure, "Error closing output file: %v", err)
+	}
+	logger.Printf("-> Wrote %d vectors.\n", written)
+	logger.Println("Done!")
+}
+
+// --- SAMPLE SUBCOMMAND ---
+
+func runSample(args []string) {
+	sampleCmd := flag.NewFlagSet("sample", flag.ExitOnError)
+	inputFile := sampleCmd.String("input", "", "Path to the GloVe vector file (- reads stdin).")
+	outputFile := sampleCmd.String("output", "sampled_vectors.txt", "Path for the sampled output file.")
+	n := sampleCmd.Int("n", 1000, "Number of lines to sample.")
+	seed := sampleCmd.Int64("seed", 42, "Seed for the random sample; the same seed and input give the same sample.")
+	keepHeader := sampleCmd.Bool("header", false, "Treat the first line as a header and copy it to the output, rewriting a numeric '<count> <dim>' header to the sample size.")
+	addCommonFlags(sampleCmd)
+	sampleCmd.Parse(args)
+
+	if *inputFile == "" {
+		log.Fatal("Error: -input flag is required for sample command.")
+	}
+	if *n < 1 {
+		log.Fatal("Error: -n must be at least 1.")
+	}
+	if err := checkOutputPath(*outputFile, *inputFile); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	file, err := openInput(*inputFile)
+	if err != nil {
+		fatalf(exitMissingInput, "Error opening input file: %v", err)
+	}
+	defer file.Close()
+	scanner := newLineScanner(file)
+	header := ""
+	if *keepHeader && scanner.Scan() {
+		header = scanner.Text()
+	}
+
+	// Reservoir sampling keeps only n lines in memory however long the input is.
+	// Each line remembers its position so the sample is written in input order
+	type sampledLine struct {
+		index int
+		line  string
+	}
+	rng := rand.New(rand.NewSource(*seed))
+	reservoir := make([]sampledLine, 0, *n)
+	seen := 0
+	logger.Printf("Sampling %d lines from %s (seed %d)...\n", *n, *inputFile, *seed)
+	progress := newProgress("lines read:", progressInterval, 0)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		progress.tick()
+		if seen < *n {
+			reservoir = append(reservoir, sampledLine{index: seen, line: line})
+		} else if j := rng.Intn(seen + 1); j < *n {
+			reservoir[j] = sampledLine{index: seen, line: line}
+		}
+		seen++
+	}
+	checkScan(scanner, "input file")
+	if seen < *n {
+		logger.Printf("Warning: the input only has %d lines, so all of them are written.\n", seen)
+	}
+	sort.Slice(reservoir, func(i, j int) bool {
+		return reservoir[i].index < reservoir[j].index
+	})
+
+	outFile, err := createOutput(*outputFile)
+	if err != nil {
+		fatalf(exitFailure, "Error creating output file: %v", err)
+	}
+	writer := bufio.NewWriter(outFile)
+	if *keepHeader {
+		if _, dim, ok := parseHeader(header); ok {
+			header = fmt.Sprintf("%d %d", len(reservoir), dim)
+		}
+		writer.WriteString(header + "\n")
+	}
+	for _, sampled := range reservoir {
+		writer.WriteString(sampled.line + "\n")
+	}
+	if err := writer.Flush(); err != nil {
+		fatalf(exitFailure, "Error writing output file: %v", err)
+	}
+	if err := outFile.Close(); err != nil {
+		fatalf(exitFailure, "Error closing output file: %v", err)
+	}
+	logger.Printf("-> Wrote %d of %d lines to %s.\n", len(reservoir), seen, *outputFile)
+	logger.Println("Done!")
+}
+
+// --- VERIFY SUBCOMMAND ---
+
+func runVerify(args []string) {
+	verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+	inputFile := verifyCmd.String("input", "", "Path to the GloVe vector file (- reads stdin).")
+	sampleSize := verifyCmd.Int("n", 100, "Number of random words to check.")
+	seed := verifyCmd.Int64("seed", 42, "Seed for picking the sampled words.")
+	loadOpts := addLoadFlags(verifyCmd)
+	addCommonFlags(verifyCmd)
+	verifyCmd.Parse(args)
+
+	if *inputFile == "" {
+		log.Fatal("Error: -input flag is required for verify command.")
+	}
+	if *sampleSize < 1 {
+		log.Fatal("Error: -n must be at least 1.")
+	}
+
+	logger.Println("Loading GloVe model...")
+	gloveMap := loadGloveModel(*inputFile, loadOpts)
+	if len(gloveMap) == 0 {
+		fatalf(exitBadFormat, "Error: no vectors found in input file.")
+	}
+	norms := vectorNorms(gloveMap)
+	cosine, _ := parseMetric("cosine")
+
+	// Sort before shuffling so the sample only depends on the seed, not on map order
+	words := make([]string, 0, len(gloveMap))
+	for word := range gloveMap {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	rng := rand.New(rand.NewSource(*seed))
+	rng.Shuffle(len(words), func(i, j int) {
+		words[i], words[j] = words[j], words[i]
+	})
+	if len(words) > *sampleSize {
+		words = words[:*sampleSize]
+	}
+
+	logger.Printf("Checking that %d sampled words are their own nearest neighbor...\n", len(words))
+	const tolerance = 1e-6
+	failed := 0
+	for _, word := range words {
+		vec := gloveMap[word]
+		if norms[word] == 0 {
+			fmt.Printf("FAIL\t%s\tzero vector, cosine is undefined\n", word)
+			failed++
+			continue
+		}
+		nearest := rankNeighbors(vec, gloveMap, norms, nil, 1, cosine)[0]
+		// Only the score counts: a different word with an identical vector ties
+		// with the word itself
+		if math.Abs(nearest.Score-1) > tolerance {
+			fmt.Printf("FAIL\t%s\tnearest is %q with score %.6f\n", word, nearest.Word, nearest.Score)
+			failed++
+		}
+	}
+	fmt.Printf("checked:\t%d\n", len(words))
+	fmt.Printf("failed:\t%d\n", failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// --- QUANTIZE SUBCOMMAND ---
+
+// quantizedMagic opens the header of files written by quantize, which is
+// followed by " <count> <dim> <scale>\n" and then, per word, its text, a space
+// and dim int8 components. Component i of a vector is q[i] * scale.
+const quantizedMagic = "glove-q8"
+
+func runQuantize(args []string) {
+	quantizeCmd := flag.NewFlagSet("quantize", flag.ExitOnError)
+	inputFile := quantizeCmd.String("input", "", "Path to the GloVe vector file (read twice, so not stdin).")
+	outputFile := quantizeCmd.String("output", "quantized_vectors.q8", "Path for the int8-quantized output file.")
+	loadOpts := addLoadFlags(quantizeCmd)
+	addCommonFlags(quantizeCmd)
+	quantizeCmd.Parse(args)
+
+	if *inputFile == "" || *inputFile == "-" {
+		log.Fatal("Error: -input must name a file for quantize command.")
+	}
+	if err := checkOutputPath(*outputFile, *inputFile); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	// The first pass only finds the shared scale, so the model is never held in memory
+	logger.Printf("Scanning %s for the largest component...\n", *inputFile)
+	count, dim, maxAbs := 0, 0, 0.0
+	streamVectors(*inputFile, loadOpts, func(word string, vec Vector) {
+		if strings.ContainsAny(word, " \n") {
+			fatalf(exitBadFormat, "Error: word %q can't be stored in the quantized format.", word)
+		}
+		count++
+		dim = len(vec)
+		for _, v := range vec {
+			maxAbs = math.Max(maxAbs, math.Abs(v))
+		}
+	})
+	if count == 0 {
+		fatalf(exitBadFormat, "Error: no vectors found in input file.")
+	}
+	scale := maxAbs / 127
+	if scale == 0 {
+		// All-zero model: any scale dequantizes back to zeros
+		scale = 1
+	}
+	logger.Printf("-> %d vectors of dimension %d, max |component| %g, scale %g.\n", count, dim, maxAbs, scale)
+
+	outFile, err := createOutput(*outputFile)
+	if err != nil {
+		fatalf(exitFailure, "Error creating output file: %v", err)
+	}
+	writer := bufio.NewWriter(outFile)
+	fmt.Fprintf(writer, "%s %d %d %s\n", quantizedMagic, count, dim, strconv.FormatFloat(scale, 'g', -1, 64))
+
+	logger.Printf("Writing %s...\n", *outputFile)
+	buf := make([]byte, dim)
+	restored := make(Vector, dim)
+	written := 0
+	sumCosine, minCosine := 0.0, 1.0
+	streamVectors(*inputFile, loadOpts, func(word string, vec Vector) {
+		for i, v := range vec {
+			q := int8(math.Max(-127, math.Min(127, math.Round(v/scale))))
+			buf[i] = byte(q)
+			restored[i] = float64(q) * scale
+		}
+		writer.WriteString(word + " ")
+		writer.Write(buf)
+		written++
+		// Track how far quantization moved each vector, to report the real error
+		if l2Norm(vec) > 0 {
+			cos := cosineSimilarity(vec, restored)
+			sumCosine += cos
+			minCosine = math.Min(minCosine, cos)
+		}
+	})
+	if written != count {
+		fatalf(exitFailure, "Error: %s changed between passes (%d vectors, then %d).", *inputFile, count, written)
+	}
+	if err := writer.Flush(); err != nil {
+		fatalf(exitFailure, "Error writing output file: %v", err)
+	}
+	if err := outFile.Close(); err != nil {
+		fatalf(exitFailure, "Error closing output file: %v", err)
+	}
+	// Each component is off by at most scale/2, which for typical 100-300
+	// dimensional GloVe models keeps cosine similarities within about 0.01
+	logger.Printf("-> Wrote %d vectors. Cosine between original and quantized vectors: mean %.6f, min %.6f.\n", written, sumCosine/float64(written), minCosine)
+	logger.Println("Done!")
+}
+
+func runDequantize(args []string) {
+	dequantizeCmd := flag.NewFlagSet("dequantize", flag.ExitOnError)
+	inputFile := dequantizeCmd.String("input", "", "Path to a file written by quantize (- reads stdin).")
+	outputFile := dequantizeCmd.String("output", "dequantized_vectors.txt", "Path for the GloVe text output file.")
+	addFormatFlags(dequantizeCmd)
+	addCommonFlags(dequantizeCmd)
+	dequantizeCmd.Parse(args)
+
+	if *inputFile == "" {
+		log.Fatal("Error: -input flag is required for dequantize command.")
+	}
+	if err := checkOutputPath(*outputFile, *inputFile); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	file, err := openInput(*inputFile)
+	if err != nil {
+		fatalf(exitMissingInput, "Error opening input file: %v", err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		fatalf(exitBadFormat, "Error reading header: %v", err)
+	}
+	var magic string
+	var count, dim int
+	var scale float64
+	if _, err := fmt.Sscanf(header, "%s %d %d %g", &magic, &count, &dim, &scale); err != nil || magic != quantizedMagic || count < 0 || dim <= 0 {
+		fatalf(exitBadFormat, "Error: %s is not a quantized vector file (header %q).", *inputFile, strings.TrimSpace(header))
+	}
+
+	outFile, err := createOutput(*outputFile)
+	if err != nil {
+		fatalf(exitFailure, "Error creating output file: %v", err)
+	}
+	writer := bufio.NewWriter(outFile)
+	logger.Printf("Dequantizing %d vectors of dimension %d (scale %g) into %s...\n", count, dim, scale, *outputFile)
+	buf := make([]byte, dim)
+	vec := make(Vector, dim)
+	progress := newProgress("vectors restored:", progressInterval, count)
+	for i := 0; i < count; i++ {
+		word, err := reader.ReadString(' ')
+		if err != nil {
+			fatalf(exitBadFormat, "Error reading word %d of %d: %v", i+1, count, err)
+		}
+		word = strings.TrimSuffix(word, " ")
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			fatalf(exitBadFormat, "Error reading vector for %q: %v", word, err)
+		}
+		for j, b := range buf {
+			vec[j] = float64(int8(b)) * scale
+		}
+		writer.WriteString(formatVector(word, vec) + "\n")
+		progress.tick()
+	}
+	if err := writer.Flush(); err != nil {
+		fatalf(exitFailure, "Error writing output file: %v", err)
+	}
+	if err := outFile.Close(); err != nil {
+		fatalf(exitFailure, "Error closing output file: %v", err)
+	}
+	logger.Println("Done!")
+}
+
+// --- CENTROID SUBCOMMAND ---
+
+func runCentroid(args []string) {
+	centroidCmd := flag.NewFlagSet("centroid", flag.ExitOnError)
+	inputFile := centroidCmd.String("input", "", "Path to the GloVe vector file (- reads stdin).")
+	vocabFile := centroidCmd.String("vocab", "", "Path to the vault vocabulary file.")
+	topN := centroidCmd.Int("topn", 0, "Number of words nearest to the centroid to print instead of the centroid vector (0 prints the vector).")
+	metricName := centroidCmd.String("metric", "cosine", metricHelp)
+	excludeVault := centroidCmd.Bool("exclude-vault", false, "Leave vault words out of the -topn ranking, so only words new to the vault are listed.")
+	name := centroidCmd.String("name", "centroid", "Word written in front of the centroid vector.")
+	lowercase := centroidCmd.Bool("lowercase", false, "Lowercase vault words before matching them against the model.")
+	loadOpts := addLoadFlags(centroidCmd)
+	addFormatFlags(centroidCmd)
+	addCommonFlags(centroidCmd)
+	addCommentFlag(centroidCmd)
+	centroidCmd.Parse(args)
+
+	if *inputFile == "" || *vocabFile == "" {
+		log.Fatal("Error: -input and -vocab flags are required for centroid command.")
+	}
+	if *topN < 0 {
+		log.Fatal("Error: -topn must not be negative.")
+	}
+	metric, err := parseMetric(*metricName)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	logger.Println("Loading vault vocabulary...")
+	vaultVocab, _, err := loadVocabulary(*vocabFile, vocabOptions{Lowercase: *lowercase})
+	if err != nil {
+		fatalf(exitCode(err), "Error: %v", err)
+	}
+	// The vector alone only needs the vault words; ranking needs the whole model
+	var gloveMap, vaultVectors map[string]Vector
+	if *topN > 0 {
+		logger.Println("Loading GloVe model...")
+		gloveMap = loadGloveModel(*inputFile, loadOpts)
+		logger.Printf("-> Loaded %d total vectors.\n", len(gloveMap))
+		vaultVectors = make(map[string]Vector, len(vaultVocab))
+		for word := range vaultVocab {
+			if vec, ok := gloveMap[word]; ok {
+				vaultVectors[word] = vec
+			}
+		}
+	} else {
+		vaultVectors = loadVaultVectors([]string{*inputFile}, loadOpts, false, vaultVocab)
+	}
+	logger.Printf("-> Found vectors for %d of %d vault words.\n", len(vaultVectors), len(vaultVocab))
+	if len(vaultVectors) == 0 {
+		fatalf(exitNoMatches, "Error: none of the %d vault words has a vector in %s", len(vaultVocab), *inputFile)
+	}
+
+	centroid := centroidVector(vaultVectors)
+	if *topN == 0 {
+		fmt.Println(formatVector(*name, centroid))
+		return
+	}
+	var exclude map[string]bool
+	if *excludeVault {
+		exclude = vaultVocab
+	}
+	for _, sim := range rankNeighbors(centroid, gloveMap, vectorNorms(gloveMap), exclude, *topN, metric) {
+		fmt.Printf("%s\t%.6f\n", sim.Word, sim.Score)
+	}
+}
+
+// centroidVector returns the mean of vectors, which must share a dimension.
+func centroidVector(vectors map[string]Vector) Vector {
+	var sum Vector
+	for _, vec := range vectors {
+		if sum == nil {
+			sum = make(Vector, len(vec))
+		}
+		for i, v := range vec {
+			sum[i] += v
+		}
+	}
+	for i := range sum {
+		sum[i] /= float64(len(vectors))
+	}
+	return sum
+}
+
+// --- COHESION SUBCOMMAND ---
+
+func runCohesion(args []string) {
+	cohesionCmd := flag.NewFlagSet("cohesion", flag.ExitOnError)
+	inputFile := cohesionCmd.String("input", "", "Path to the GloVe vector file (- reads stdin).")
+	vocabFile := cohesionCmd.String("vocab", "", "Path to the vault vocabulary file.")
+	sampleSize := cohesionCmd.Int("sample", 0, "Score this many random vault-word pairs instead of every pair, for large vaults (0 scores them all).")
+	seed := cohesionCmd.Int64("seed", 42, "Seed for picking the -sample pairs.")
+	lowercase := cohesionCmd.Bool("lowercase", false, "Lowercase vault words before matching them against the model.")
+	loadOpts := addLoadFlags(cohesionCmd)
+	addCommonFlags(cohesionCmd)
+	addCommentFlag(cohesionCmd)
+	cohesionCmd.Parse(args)
+
+	if *inputFile == "" || *vocabFile == "" {
+		log.Fatal("Error: -input and -vocab flags are required for cohesion command.")
+	}
+	if *sampleSize < 0 {
+		log.Fatal("Error: -sample must be positive (or 0 to score every pair).")
+	}
+
+	logger.Println("Loading vault vocabulary...")
+	vaultVocab, _, err := loadVocabulary(*vocabFile, vocabOptions{Lowercase: *lowercase})
+	if err != nil {
+		fatalf(exitCode(err), "Error: %v", err)
+	}
+	vaultVectors := loadVaultVectors([]string{*inputFile}, loadOpts, false, vaultVocab)
+	logger.Printf("-> Found vectors for %d of %d vault words.\n", len(vaultVectors), len(vaultVocab))
+	norms := vectorNorms(vaultVectors)
+
+	// Sorted so that a -sample only depends on the seed, not on map order.
+	// Zero vectors have no direction, so they would only drag the mean to 0
+	words := make([]string, 0, len(vaultVectors))
+	zero := 0
+	for word := range vaultVectors {
+		if norms[word] == 0 {
+			zero++
+			continue
+		}
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	if zero > 0 {
+		logger.Printf("Warning: leaving out %d vault words with zero vectors.\n", zero)
+	}
+	if len(words) < 2 {
+		fatalf(exitNoMatches, "Error: cohesion needs at least 2 vault words with vectors, found %d.", len(words))
+	}
+
+	var sum, sumSquares float64
+	pairs := 0
+	add := func(a, b string) {
+		sim := cosineWithNorms(vaultVectors[a], vaultVectors[b], norms[a], norms[b])
+		sum += sim
+		sumSquares += sim * sim
+		pairs++
+	}
+	if *sampleSize > 0 {
+		rng := rand.New(rand.NewSource(*seed))
+		for pairs < *sampleSize {
+			i, j := rng.Intn(len(words)), rng.Intn(len(words))
+			if i != j {
+				add(words[i], words[j])
+			}
+		}
+	} else {
+		for i := range words {
+			for j := i + 1; j < len(words); j++ {
+				add(words[i], words[j])
+			}
+		}
+	}
+
+	mean := sum / float64(pairs)
+	// Clamped since rounding can leave a tiny negative variance
+	stddev := math.Sqrt(math.Max(0, sumSquares/float64(pairs)-mean*mean))
+	fmt.Printf("words:\t%d\n", len(words))
+	fmt.Printf("pairs:\t%d\n", pairs)
+	fmt.Printf("mean:\t%.6f\n", mean)
+	fmt.Printf("stddev:\t%.6f\n", stddev)
+}
+
+// --- ANALOGY SUBCOMMAND ---
+
+func runAnalogy(args []string) {
+	analogyCmd := flag.NewFlagSet("analogy", flag.ExitOnError)
+	inputFile := analogyCmd.String("input", "", "Path to the GloVe vector file (- reads stdin).")
+	expr := analogyCmd.String("expr", "", "Vector expression such as \"king - man + woman\" (operators must be separated by spaces).")
+	opsFile := analogyCmd.String("vector-ops", "", "File of vector expressions, one per line (-comment lines are skipped), all answered from a single model load instead of -expr.")
+	topN := analogyCmd.Int("topn", 5, "Number of nearest neighbors to print.")
+	metricName := analogyCmd.String("metric", "cosine", metricHelp)
+	loadOpts := addLoadFlags(analogyCmd)
+	addCommonFlags(analogyCmd)
+	addCommentFlag(analogyCmd)
+	analogyCmd.Parse(args)
+
+	if *inputFile == "" || (*expr == "") == (*opsFile == "") {
+		log.Fatal("Error: -input and one of -expr or -vector-ops are required for analogy command.")
+	}
+	if *topN < 1 {
+		log.Fatal("Error: -topn must be at least 1.")
+	}
+	metric, err := parseMetric(*metricName)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	// Every expression is parsed before the model is loaded, so a typo on the
+	// last line doesn't cost a full load
+	var exprs []string
+	var parsed [][]signedTerm
+	if *opsFile != "" {
+		forEachLine(*opsFile, func(line string) {
+			line = strings.TrimSpace(line)
+			if vocabComment != "" && strings.HasPrefix(line, vocabComment) {
+				return
+			}
+			terms, err := parseExpression(line)
+			if err != nil {
+				fatalf(exitBadFormat, "Error: %s: %v", *opsFile, err)
+			}
+			exprs = append(exprs, line)
+			parsed = append(parsed, terms)
+		})
+		if len(parsed) == 0 {
+			fatalf(exitBadFormat, "Error: %s has no expressions.", *opsFile)
+		}
+	} else {
+		terms, err := parseExpression(*expr)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		exprs, parsed = []string{*expr}, [][]signedTerm{terms}
+	}
+
+	logger.Println("Loading GloVe model...")
+	gloveMap := loadGloveModel(*inputFile, loadOpts)
+	logger.Printf("-> Loaded %d total vectors.\n", len(gloveMap))
+	norms := vectorNorms(gloveMap)
+
+	if *opsFile == "" {
+		neighbors, err := analogyNeighbors(parsed[0], gloveMap, norms, *topN, metric)
+		if err != nil {
+			fatalf(exitNoMatches, "Error: %v", err)
+		}
+		for _, sim := range neighbors {
+			fmt.Printf("%s\t%.6f\n", sim.Word, sim.Score)
+		}
+		return
+	}
+	// Each expression is printed on its own line above its neighbors, with a
+	// blank line between groups
+	answered := 0
+	for i, terms := range parsed {
+		neighbors, err := analogyNeighbors(terms, gloveMap, norms, *topN, metric)
+		if err != nil {
+			logger.Printf("Warning: skipping %q: %v\n", exprs[i], err)
+			continue
+		}
+		if answered > 0 {
+			fmt.Println()
+		}
+		answered++
+		fmt.Println(exprs[i])
+		for _, sim := range neighbors {
+			fmt.Printf("%s\t%.6f\n", sim.Word, sim.Score)
+		}
+	}
+	if answered == 0 {
+		fatalf(exitNoMatches, "Error: none of the %d expressions could be evaluated.", len(parsed))
+	}
+	logger.Printf("-> Answered %d of %d expressions.\n", answered, len(parsed))
+}
+
+// analogyNeighbors evaluates terms and ranks the topN words closest to the
+// result, leaving out the words of the expression itself.
+func analogyNeighbors(terms []signedTerm, gloveMap map[string]Vector, norms map[string]float64, topN int, metric Metric) ([]Similarity, error) {
+	target, err := evaluateExpression(terms, gloveMap)
+	if err != nil {
+		return nil, err
+	}
+	exclude := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		exclude[term.Word] = true
+	}
+	return rankNeighbors(target, gloveMap, norms, exclude, topN, metric), nil
+}
+
+// signedTerm is one word of a vector expression with the sign it is applied with.
+type signedTerm struct {
+	Word string
+	Sign float64
+}
+
+// parseExpression splits an expression like "king - man + woman" into signed terms.
+// An operator is either its own token or glued to the front of a word ("-man").
+func parseExpression(expr string) ([]signedTerm, error) {
+	var terms []signedTerm
+	sign := 1.0
+	pendingOp := false
+	for _, token := range strings.Fields(expr) {
+		switch token {
+		case "+", "-":
+			if pendingOp {
+				return nil, fmt.Errorf("two operators in a row in expression %q", expr)
+			}
+			if token == "-" {
+				sign = -1
+			}
+			pendingOp = true
+			continue
+		}
+		if !pendingOp && len(token) > 1 && (token[0] == '+' || token[0] == '-') {
+			if token[0] == '-' {
+				sign = -1
+			}
+			token = token[1:]
+		} else if !pendingOp && len(terms) > 0 {
+			return nil, fmt.Errorf("missing operator before %q in expression %q", token, expr)
+		}
+		terms = append(terms, signedTerm{Word: token, Sign: sign})
+		sign, pendingOp = 1, false
+	}
+	if pendingOp {
+		return nil, fmt.Errorf("expression %q ends with an operator", expr)
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	return terms, nil
+}
+
+// evaluateExpression sums the signed vectors of terms, failing if any word is
+// missing from gloveMap.
+func evaluateExpression(terms []signedTerm, gloveMap map[string]Vector) (Vector, error) {
+	var result Vector
+	for _, term := range terms {
+		vec, ok := gloveMap[term.Word]
+		if !ok {
+			return nil, fmt.Errorf("word %q not found in model", term.Word)
+		}
+		if result == nil {
+			result = make(Vector, len(vec))
+		}
+		for i := range result {
+			result[i] += term.Sign * vec[i]
+		}
+	}
+	return result, nil
+}
+
+// --- SHARED HELPER FUNCTIONS ---
+
+// stringList is a flag.Value that accepts repeated flags and comma-separated values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// maxLineSize bounds the length of a single line any scanner will accept.
+// 300-dimensional vectors easily exceed bufio's default 64KB token limit.
+var maxLineSize = 16 * 1024 * 1024
+
+// progressInterval is how many lines pass between progress lines when streaming files.
+const progressInterval = 100000
+
+// progressEstimateLines is how many lines are measured to guess the line count
+// of a file without a header from its size.
+const progressEstimateLines = 1000
+
+// showProgress enables periodic progress lines on long-running loops.
+// It defaults to on only when stderr is a terminal, so piped runs stay clean.
+var showProgress = stderrIsTerminal()
+
+// openRetries is how many more times a transient failure to open an input is
+// retried (see openWithRetry), for network-mounted files that blink out.
+var openRetries = 3
+
+// httpTimeout bounds a whole download of an http(s) input, body included; 0
+// waits as long as the transfer takes.
+var httpTimeout time.Duration
+
+// vocabComment starts the comment lines of a vocabulary or -vector-ops file,
+// which are skipped like blank lines; empty means every line counts.
+var vocabComment = "#"
+
+// reportMemory enables memory usage lines after each model load and at the end
+// of a run, to tell whether a model fits before trying a bigger one.
+var reportMemory bool
+
+// addCommonFlags registers the flags shared by every subcommand.
+func addCommonFlags(fs *flag.FlagSet) {
+	fs.IntVar(&maxLineSize, "maxline", maxLineSize, "Maximum length in bytes of a single input line.")
+	fs.BoolVar(&showProgress, "progress", showProgress, "Print periodic progress lines (default on when stderr is a terminal).")
+	fs.DurationVar(&httpTimeout, "http-timeout", httpTimeout, "Give up on an http(s) -input that hasn't fully downloaded within this long, e.g. 10m (0 means no limit).")
+	fs.BoolVar(&reportMemory, "mem", reportMemory, "Print the heap in use and the peak memory obtained from the OS after loading a model and at the end of the run.")
+	fs.IntVar(&openRetries, "open-retries", openRetries, "Times to retry opening an input after a transient I/O error, with doubling backoff (missing or unreadable files fail at once).")
+	fs.Var(levelFlag(levelError), "quiet", "Only print errors: no progress, information or warnings.")
+	fs.Var(levelFlag(levelVerbose), "verbose", "Also print per-line detail, such as why each skipped model line was skipped.")
+}
+
+// addCommentFlag registers -comment on the subcommands that read vocabulary
+// or expression files.
+func addCommentFlag(fs *flag.FlagSet) {
+	fs.StringVar(&vocabComment, "comment", vocabComment, "Skip vocabulary and expression file lines starting with this, after leading spaces (empty reads every line).")
+}
+
+// logLevel orders how much a command reports on stderr.
+type logLevel int
+
+const (
+	levelError   logLevel = iota // -quiet: only fatal errors
+	levelInfo                    // the default
+	levelVerbose                 // -verbose: extra detail
+)
+
+// leveledLogger drops messages above its level. Fatal errors bypass it and
+// always go through log.Fatal.
+type leveledLogger struct {
+	level logLevel
+}
+
+var logger = &leveledLogger{level: levelInfo}
+
+func (l *leveledLogger) enabled(level logLevel) bool {
+	return l.level >= level
+}
+
+// Printf and Println log informational messages, including warnings.
+func (l *leveledLogger) Printf(format string, args ...interface{}) {
+	if l.enabled(levelInfo) {
+		log.Printf(format, args...)
+	}
+}
+
+func (l *leveledLogger) Println(args ...interface{}) {
+	if l.enabled(levelInfo) {
+		log.Println(args...)
+	}
+}
+
+// Verbosef logs detail only wanted with -verbose.
+func (l *leveledLogger) Verbosef(format string, args ...interface{}) {
+	if l.enabled(levelVerbose) {
+		log.Printf(format, args...)
+	}
+}
+
+// levelFlag is a boolean flag that switches logger to its level when set.
+type levelFlag logLevel
+
+func (f levelFlag) String() string   { return "false" }
+func (f levelFlag) IsBoolFlag() bool { return true }
+
+func (f levelFlag) Set(value string) error {
+	on, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	if on {
+		logger.level = logLevel(f)
+	} else if logger.level == logLevel(f) {
+		logger.level = levelInfo
+	}
+	return nil
+}
+
+// writeBufferSize and flushEvery tune how prune and split write their output:
+// the bufio buffer size, and how many lines pass between forced flushes (0 only
+// flushes when the buffer fills). Small regular flushes suit network filesystems
+// that stall on large bursts.
+var (
+	writeBufferSize = byteSize(64 << 10)
+	flushEvery      = 0
+)
+
+// addWriteFlags registers the output buffering flags.
+func addWriteFlags(fs *flag.FlagSet) {
+	fs.Var(&writeBufferSize, "bufsize", "Output buffer size, e.g. 64K (the default) for local disks or 1M for NFS.")
+	fs.IntVar(&flushEvery, "flush-every", flushEvery, "Flush the output every N lines instead of only when the buffer fills (0 disables).")
+}
+
+// newOutputWriter buffers w with the -bufsize buffer.
+func newOutputWriter(w io.Writer) *bufio.Writer {
+	return bufio.NewWriterSize(w, int(writeBufferSize))
+}
+
+// flushPeriodically flushes writer after every -flush-every lines, given the
+// number of lines written so far.
+func flushPeriodically(writer *bufio.Writer, lines int) error {
+	if flushEvery > 0 && lines%flushEvery == 0 {
+		return writer.Flush()
+	}
+	return nil
+}
+
+// outputPrecision and outputDelimiter control how formatVector renders vectors:
+// the number of decimals (-1 for the shortest exact representation) and the
+// separator between the word and each value.
+var (
+	outputPrecision = -1
+	outputDelimiter = " "
+)
+
+// delimiterFlag is the flag.Value behind -delimiter, accepting "space" or "tab".
+type delimiterFlag struct{}
+
+func (delimiterFlag) String() string {
+	if outputDelimiter == "\t" {
+		return "tab"
+	}
+	return "space"
+}
+
+func (delimiterFlag) Set(value string) error {
+	switch value {
+	case "space":
+		outputDelimiter = " "
+	case "tab":
+		outputDelimiter = "\t"
+	default:
+		return fmt.Errorf("expected 'space' or 'tab', got %q", value)
+	}
+	return nil
+}
+
+// addFormatFlags registers the flags of subcommands that write reformatted vectors.
+func addFormatFlags(fs *flag.FlagSet) {
+	fs.IntVar(&outputPrecision, "precision", outputPrecision, "Decimal digits per written value (-1 keeps full precision).")
+	fs.Var(delimiterFlag{}, "delimiter", "Separator between the word and values of written vectors: 'space' or 'tab'.")
+}
+
+// customFormat reports whether -precision or -delimiter asked for non-default output.
+func customFormat() bool {
+	return outputPrecision != -1 || outputDelimiter != " "
+}
+
+func stderrIsTerminal() bool {
+	info, err := os.Stderr.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressCounter logs a line every `every` ticks while showProgress is set,
+// with the rate so far and, once the total is known, the time left.
+// It is safe for concurrent use.
+type progressCounter struct {
+	label string
+	every int64
+	total int64
+	count int64
+	start time.Time
+	// estimated marks a total guessed by setTotal rather than known exactly.
+	estimated int32
+}
+
+// newProgress creates a counter; total may be 0 when the final count is unknown.
+func newProgress(label string, every, total int) *progressCounter {
+	if every < 1 {
+		every = 1
+	}
+	return &progressCounter{label: label, every: int64(every), total: int64(total), start: time.Now()}
+}
+
+// setTotal sets the total once it becomes known partway through, such as from
+// a header, or as a guess from the file size when estimated.
+func (p *progressCounter) setTotal(total int, estimated bool) {
+	flag := int32(0)
+	if estimated {
+		flag = 1
+	}
+	atomic.StoreInt32(&p.estimated, flag)
+	atomic.StoreInt64(&p.total, int64(total))
+}
+
+func (p *progressCounter) tick() {
+	n := atomic.AddInt64(&p.count, 1)
+	if !showProgress || !logger.enabled(levelInfo) || n%p.every != 0 {
+		return
+	}
+	elapsed := time.Since(p.start)
+	rate := float64(n) / elapsed.Seconds()
+	total := atomic.LoadInt64(&p.total)
+	if total <= 0 {
+		logger.Printf("... %s %d (%.0f/s)\n", p.label, n, rate)
+		return
+	}
+	approx := ""
+	if atomic.LoadInt32(&p.estimated) == 1 {
+		approx = "~"
+	}
+	left := "almost done"
+	if n < total {
+		remaining := time.Duration(float64(total-n) / rate * float64(time.Second))
+		left = fmt.Sprintf("%s%v left", approx, remaining.Round(time.Second))
+	}
+	logger.Printf("... %s %d/%s%d (%.0f%%, %.0f/s, %s)\n", p.label, n, approx, total, 100*float64(n)/float64(total), rate, left)
+}
+
+// phaseTimer records how long each consecutive phase of a command takes.
+type phaseTimer struct {
+	start  time.Time
+	last   time.Time
+	phases []string
+	times  []time.Duration
+}
+
+func newPhaseTimer() *phaseTimer {
+	now := time.Now()
+	return &phaseTimer{start: now, last: now}
+}
+
+// mark ends the current phase, attributing the time since the previous mark to name.
+func (t *phaseTimer) mark(name string) {
+	now := time.Now()
+	t.phases = append(t.phases, name)
+	t.times = append(t.times, now.Sub(t.last))
+	t.last = now
+}
+
+// report prints each phase's duration and share of the total to stderr.
+func (t *phaseTimer) report() {
+	total := t.last.Sub(t.start)
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "phase\tduration\tshare\t")
+	for i, name := range t.phases {
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(t.times[i]) / float64(total)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.1f%%\t\n", name, t.times[i].Round(time.Millisecond), share)
+	}
+	fmt.Fprintf(w, "total\t%s\t100.0%%\t\n", total.Round(time.Millisecond))
+	w.Flush()
+}
+
+// logMemory logs the live heap and the memory the runtime holds from the OS
+// with -mem. The runtime seldom hands memory back, so the latter is close to
+// the peak resident size so far.
+func logMemory(stage string) {
+	if !reportMemory {
+		return
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	logger.Printf("-> Memory %s: %s heap in use, %s obtained from the OS.\n", stage, formatBytes(int64(stats.HeapAlloc)), formatBytes(int64(stats.Sys)))
+}
+
+// newLineScanner returns a line scanner that accepts lines up to maxLineSize bytes.
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	// The scanner's limit is the larger of the initial capacity and the max
+	initial := 64 * 1024
+	if initial > maxLineSize {
+		initial = maxLineSize
+	}
+	scanner.Buffer(make([]byte, 0, initial), maxLineSize)
+	scanner.Split(scanTextLines())
+	return scanner
+}
+
+// utf8BOM is the byte order mark some Windows editors put at the start of a file.
+var utf8BOM = []byte("\uFEFF")
+
+// scanTextLines is bufio.ScanLines for files edited on Windows: it drops a BOM
+// before the first line, which would otherwise stick to the first word, and
+// the \r of every \r\n ending (ScanLines already does, but words must never
+// depend on that).
+func scanTextLines() bufio.SplitFunc {
+	first := true
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token == nil {
+			return advance, token, err
+		}
+		if first {
+			first = false
+			token = bytes.TrimPrefix(token, utf8BOM)
+		}
+		return advance, bytes.TrimSuffix(token, []byte("\r")), err
+	}
+}
+
+// scanRawLines is bufio.ScanLines without the stripping: every line keeps its
+// \n or \r\n ending, and the first line its BOM, so split and join copy what
+// they read as is and their checksums cover the line endings too.
+func scanRawLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// trimRawLine strips the ending of a line read by scanRawLines.
+func trimRawLine(line string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+}
+
+// rawLineEnding returns the ending of a line read by scanRawLines, or "\n" for
+// an unterminated last line.
+func rawLineEnding(line string) string {
+	if ending := line[len(trimRawLine(line)):]; ending != "" {
+		return ending
+	}
+	return "\n"
+}
+
+// checkScan aborts if scanner stopped on an error rather than at end of input.
+func checkScan(scanner *bufio.Scanner, what string) {
+	if err := scanError(scanner, what); err != nil {
+		fatalf(exitFailure, "Error %v", err)
+	}
+}
+
+// scanError is checkScan for callers that return errors instead of exiting.
+func scanError(scanner *bufio.Scanner, what string) error {
+	err := scanner.Err()
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("reading %s: a line is longer than %d bytes (raise -maxline)", what, maxLineSize)
+	}
+	return fmt.Errorf("reading %s: %v", what, err)
+}
+
+// loadOptions controls how vector files are parsed.
+type loadOptions struct {
+	// Strict turns any malformed line into a fatal error instead of skipping it.
+	Strict bool
+	// Binary reads the word2vec binary format instead of whitespace-separated text.
+	Binary bool
+	// Lowercase folds every model word to lower case as it is read.
+	Lowercase bool
+	// SkipHeader treats the first line of a text model as a header even when it
+	// doesn't look like the "<count> <dim>" line of fastText .vec files.
+	SkipHeader bool
+	// TabWord takes everything before the first tab of a text line as the word,
+	// so multi-word entries like "new york\t0.1 0.2" keep their spaces.
+	TabWord bool
+	// TrimWord trims each model word and collapses runs of whitespace inside it,
+	// including non-breaking spaces, to a single space (see trimWord).
+	TrimWord bool
+	// LoadWorkers, if above 1, parses text models on that many goroutines (see
+	// parsePool) instead of the reading one.
+	LoadWorkers int
+	// ExpectDim, if positive, is the only dimension a model may have: a header
+	// or first vector of any other dimension is an error (see checkExpectedDim).
+	ExpectDim int
+}
+
+// checkExpectedDim fails if ExpectDim is set and dim, found in what (such as
+// "header"), differs from it. Later lines are then held to dim as usual, so
+// this one check covers the whole file.
+func (o *loadOptions) checkExpectedDim(dim int, what string) error {
+	if o.ExpectDim > 0 && dim != o.ExpectDim {
+		return withExitCode(exitBadFormat, fmt.Errorf("the model's %s has %d dimensions, but -expect-dim is %d; is -input the right file?", what, dim, o.ExpectDim))
+	}
+	return nil
+}
+
+// addLoadFlags registers the vector-parsing flags on fs.
+func addLoadFlags(fs *flag.FlagSet) *loadOptions {
+	opts := &loadOptions{}
+	fs.BoolVar(&opts.Strict, "strict", false, "Fail on malformed vector lines instead of skipping them.")
+	fs.BoolVar(&opts.Binary, "binary", false, "Input is in the binary word2vec format (implied by a .bin or .bin.gz suffix).")
+	fs.BoolVar(&opts.Lowercase, "lowercase-model", false, "Lowercase model words on load so they match regardless of case.")
+	fs.BoolVar(&opts.SkipHeader, "skip-header", false, "Always skip the first line of a text model (a '<count> <dim>' first line is detected and skipped anyway).")
+	fs.BoolVar(&opts.TrimWord, "trim-word", false, "Trim model words and collapse any whitespace inside them (non-breaking spaces too) to one space, matching how vocabulary lines are trimmed.")
+	fs.IntVar(&opts.ExpectDim, "expect-dim", 0, "Fail unless the model's vectors have exactly this many dimensions, to catch a wrong -input early (0 accepts any).")
+	fs.IntVar(&opts.LoadWorkers, "load-workers", 0, "Parse text models on this many goroutines, which speeds up loading 300-dimensional models on multicore machines (0 or 1 parses while reading).")
+	fs.Var(wordSepFlag{&opts.TabWord}, "sep", "What ends the word on a text model line: 'space' (the first whitespace) or 'tab' (the word is everything before the first tab and may contain spaces).")
+	return opts
+}
+
+// wordSepFlag is the -sep flag, which sets loadOptions.TabWord.
+type wordSepFlag struct{ tab *bool }
+
+func (w wordSepFlag) String() string {
+	if w.tab != nil && *w.tab {
+		return "tab"
+	}
+	return "space"
+}
+
+func (w wordSepFlag) Set(value string) error {
+	switch value {
+	case "space":
+		*w.tab = false
+	case "tab":
+		*w.tab = true
+	default:
+		return fmt.Errorf("expected 'space' or 'tab', got %q", value)
+	}
+	return nil
+}
+
+// isBinary reports whether filePath should be parsed as binary word2vec.
+func (o *loadOptions) isBinary(filePath string) bool {
+	return o.Binary || strings.HasSuffix(strings.TrimSuffix(filePath, ".gz"), ".bin")
+}
+
+func loadGloveModel(filePath string, opts *loadOptions) map[string]Vector {
+	gloveMap := make(map[string]Vector)
+	streamVectors(filePath, opts, func(word string, vec Vector) {
+		gloveMap[word] = vec
+	})
+	logMemory("after loading " + filePath)
+	return gloveMap
+}
+
+// parseGloveReader loads a model from r instead of a path, e.g. synthetic data
+// in tests and benchmarks. A nil opts parses plain text with the defaults;
+// opts.Binary selects word2vec binary, since there is no suffix to go by.
+func parseGloveReader(r io.Reader, opts *loadOptions) (map[string]Vector, error) {
+	if opts == nil {
+		opts = &loadOptions{}
+	}
+	gloveMap := make(map[string]Vector)
+	err := scanVectors(r, opts, opts.Binary, func(word string, vec Vector) {
+		gloveMap[word] = vec
+	})
+	return gloveMap, err
+}
+
+// loadGloveModelOrdered is loadGloveModel that also returns the words in the
+// order they first appear in the file, for output that must keep that order.
+func loadGloveModelOrdered(filePath string, opts *loadOptions) (map[string]Vector, []string) {
+	gloveMap, order, err := readGloveModelOrdered(filePath, opts)
+	if err != nil {
+		fatalf(exitCode(err), "Error: %v", err)
+	}
+	return gloveMap, order
+}
+
+// readGloveModelOrdered is loadGloveModelOrdered for callers that return errors
+// instead of exiting.
+func readGloveModelOrdered(filePath string, opts *loadOptions) (map[string]Vector, []string, error) {
+	gloveMap := make(map[string]Vector)
+	var order []string
+	err := readVectors(filePath, opts, func(word string, vec Vector) {
+		if _, seen := gloveMap[word]; !seen {
+			order = append(order, word)
+		}
+		gloveMap[word] = vec
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	logMemory("after loading " + filePath)
+	return gloveMap, order, nil
+}
+
+// readGloveModels loads several models into one map, checking that they share a
+// dimension. A word in more than one file keeps its vector from the first file
+// that has it, or from the last one with lastWins. The returned slice lists the
+// words in the order they were first seen across the files.
+func readGloveModels(filePaths []string, opts *loadOptions, lastWins bool) (map[string]Vector, []string, error) {
+	merged := make(map[string]Vector)
+	var mergedOrder []string
+	dim, dimFile := -1, ""
+	conflicts := 0
+	for _, filePath := range filePaths {
+		logger.Printf("Loading %s...\n", filePath)
+		gloveMap, order, err := readGloveModelOrdered(filePath, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Printf("-> Loaded %d vectors.\n", len(gloveMap))
+		if len(gloveMap) == 0 {
+			continue
+		}
+		if fileDim := vectorDim(gloveMap); dim == -1 {
+			dim, dimFile = fileDim, filePath
+		} else if fileDim != dim {
+			return nil, nil, withExitCode(exitBadFormat, fmt.Errorf("%s has %d dimensions but %s has %d", filePath, fileDim, dimFile, dim))
+		}
+		for _, word := range order {
+			if _, seen := merged[word]; seen {
+				conflicts++
+				if !lastWins {
+					continue
+				}
+			} else {
+				mergedOrder = append(mergedOrder, word)
+			}
+			merged[word] = gloveMap[word]
+		}
+	}
+	logger.Printf("-> Combined vocabulary: %d words (%d duplicate entries resolved).\n", len(merged), conflicts)
+	return merged, mergedOrder, nil
+}
+
+// modelCacheMagic opens the files written by writeModelCache. It is followed by
+// a line identifying the input and load options the cache was built from, then
+// a little-endian uint64 count and uint32 dim, and per word, in model order, a
+// uvarint length, the word and dim float64 components.
+const modelCacheMagic = "glove-cache1"
+
+// modelCacheKey identifies what a cache of inputFile was built from, so changing
+// the input or a flag that affects parsing rebuilds it.
+func modelCacheKey(inputFile string, info os.FileInfo, opts *loadOptions) string {
+	if abs, err := filepath.Abs(inputFile); err == nil {
+		inputFile = abs
+	}
+	return fmt.Sprintf("%s size=%d binary=%t strict=%t lowercase=%t skipheader=%t tab=%t trim=%t",
+		inputFile, info.Size(), opts.isBinary(inputFile), opts.Strict, opts.Lowercase, opts.SkipHeader, opts.TabWord, opts.TrimWord)
+}
+
+// loadModelCached loads inputFile from cacheFile when the cache is newer than
+// the input and matches its key, and otherwise parses inputFile and writes the
+// cache for next time. The cache holds the vectors as parsed rather than unit
+// vectors, since prune also writes them and scores them by dot or distance.
+// The words are returned in model order too, as loadGloveModelOrdered does.
+func loadModelCached(inputFile, cacheFile string, opts *loadOptions) (map[string]Vector, []string, error) {
+	inputInfo, err := os.Stat(inputFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := modelCacheKey(inputFile, inputInfo, opts)
+	if cacheInfo, err := os.Stat(cacheFile); err == nil && cacheInfo.ModTime().After(inputInfo.ModTime()) {
+		gloveMap, order, err := readModelCache(cacheFile, key)
+		if err == nil {
+			logger.Printf("-> Read the parsed model from cache %s.\n", cacheFile)
+			logMemory("after reading cache " + cacheFile)
+			if len(gloveMap) > 0 {
+				if err := opts.checkExpectedDim(vectorDim(gloveMap), "cache"); err != nil {
+					return nil, nil, err
+				}
+			}
+			return gloveMap, order, nil
+		}
+		logger.Printf("Warning: not using cache %s: %v\n", cacheFile, err)
+	}
+	gloveMap, order, err := readGloveModelOrdered(inputFile, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeModelCache(cacheFile, key, gloveMap, order); err != nil {
+		// A missing cache only costs the next run another parse
+		logger.Printf("Warning: could not write cache %s: %v\n", cacheFile, err)
+	} else {
+		logger.Printf("-> Wrote the parsed model to cache %s.\n", cacheFile)
+	}
+	return gloveMap, order, nil
+}
+
+// readModelCache reads a cache written by writeModelCache, failing if it was
+// built under a different key.
+func readModelCache(cacheFile, key string) (map[string]Vector, []string, error) {
+	file, err := os.Open(cacheFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(file)
+	header, err := reader.ReadString('\n')
+	if err != nil || header != modelCacheMagic+"\n" {
+		return nil, nil, errors.New("not a model cache")
+	}
+	cachedKey, err := reader.ReadString('\n')
+	if err != nil || cachedKey != key+"\n" {
+		return nil, nil, errors.New("built from a different input or load flags")
+	}
+	var count uint64
+	var dim uint32
+	if err := binary.Read(reader, binary.LittleEndian, &count); err != nil {
+		return nil, nil, err
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &dim); err != nil {
+		return nil, nil, err
+	}
+	// Every word takes at least a length byte and its components, so counts
+	// the rest of the file can't hold mean a corrupt cache, and are turned
+	// down before anything is allocated for them
+	remaining := uint64(info.Size() - int64(len(header)+len(cachedKey)) - 12)
+	if count > 0 && (dim == 0 || uint64(dim) > remaining/8 || count > remaining/(1+8*uint64(dim))) {
+		return nil, nil, fmt.Errorf("corrupt: %d words of %d dimensions can't fit in the %d bytes that follow the header", count, dim, remaining)
+	}
+	gloveMap := make(map[string]Vector, count)
+	order := make([]string, 0, count)
+	for i := uint64(0); i < count; i++ {
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("truncated after %d of %d words: %w", i, count, err)
+		}
+		if length > remaining {
+			return nil, nil, fmt.Errorf("corrupt: word %d claims %d bytes, more than the file holds", i+1, length)
+		}
+		word := make([]byte, length)
+		if _, err := io.ReadFull(reader, word); err != nil {
+			return nil, nil, fmt.Errorf("truncated after %d of %d words: %w", i, count, err)
+		}
+		vec := make(Vector, dim)
+		if err := binary.Read(reader, binary.LittleEndian, vec); err != nil {
+			return nil, nil, fmt.Errorf("truncated after %d of %d words: %w", i, count, err)
+		}
+		gloveMap[string(word)] = vec
+		order = append(order, string(word))
+	}
+	return gloveMap, order, nil
+}
+
+// writeModelCache writes the words of order, with their gloveMap vectors, to
+// cacheFile in the modelCacheMagic format.
+func writeModelCache(cacheFile, key string, gloveMap map[string]Vector, order []string) error {
+	out, err := createOutput(cacheFile)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(out)
+	fmt.Fprintf(writer, "%s\n%s\n", modelCacheMagic, key)
+	binary.Write(writer, binary.LittleEndian, uint64(len(gloveMap)))
+	binary.Write(writer, binary.LittleEndian, uint32(vectorDim(gloveMap)))
+	var length [binary.MaxVarintLen64]byte
+	for _, word := range order {
+		writer.Write(length[:binary.PutUvarint(length[:], uint64(len(word)))])
+		writer.WriteString(word)
+		binary.Write(writer, binary.LittleEndian, gloveMap[word])
+	}
+	// A cache cut short by a failed write is rejected as truncated and rebuilt
+	if err := writer.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// loadVaultVectors returns just the vectors of vaultVocab's words, streaming a
+// single input instead of loading the whole model into memory.
+func loadVaultVectors(filePaths []string, opts *loadOptions, lastWins bool, vaultVocab map[string]bool) map[string]Vector {
+	vectors, _, err := readVaultVectors(filePaths, opts, lastWins, vaultVocab)
+	if err != nil {
+		fatalf(exitCode(err), "Error: %v", err)
+	}
+	return vectors
+}
+
+// readVaultVectors is loadVaultVectors for callers that return errors instead
+// of exiting. It also returns the kept words in the order they first appear in
+// the models.
+func readVaultVectors(filePaths []string, opts *loadOptions, lastWins bool, vaultVocab map[string]bool) (map[string]Vector, []string, error) {
+	if len(filePaths) > 1 {
+		// Conflicts and dimensions are resolved across the full models
+		gloveMap, order, err := readGloveModels(filePaths, opts, lastWins)
+		if err != nil {
+			return nil, nil, err
+		}
+		for word := range gloveMap {
+			if !vaultVocab[word] {
+				delete(gloveMap, word)
+			}
+		}
+		kept := order[:0]
+		for _, word := range order {
+			if vaultVocab[word] {
+				kept = append(kept, word)
+			}
+		}
+		return gloveMap, kept, nil
+	}
+	vectors := make(map[string]Vector)
+	var order []string
+	err := readVectors(filePaths[0], opts, func(word string, vec Vector) {
+		if vaultVocab[word] {
+			if _, seen := vectors[word]; !seen {
+				order = append(order, word)
+			}
+			vectors[word] = vec
+		}
+	})
+	return vectors, order, err
+}
+
+// streamVectors parses the vector file at filePath and calls fn for every valid
+// vector in file order, without keeping any of them in memory.
+func streamVectors(filePath string, opts *loadOptions, fn func(word string, vec Vector)) {
+	if err := readVectors(filePath, opts, fn); err != nil {
+		fatalf(exitCode(err), "Error: %v", err)
+	}
+}
+
+// readVectors is streamVectors for callers that return errors instead of
+// exiting. fn may already have seen some vectors when it fails.
+func readVectors(filePath string, opts *loadOptions, fn func(word string, vec Vector)) error {
+	file, err := openInput(filePath)
+	if err != nil {
+		return withExitCode(exitMissingInput, fmt.Errorf("opening GloVe file: %w", err))
+	}
+	defer file.Close()
+	return scanVectors(file, opts, opts.isBinary(filePath), fn)
+}
+
+// scanVectors calls fn for every valid vector read from r, in either format.
+func scanVectors(r io.Reader, opts *loadOptions, binary bool, fn func(word string, vec Vector)) error {
+	if opts.Lowercase {
+		next := fn
+		fn = func(word string, vec Vector) {
+			next(strings.ToLower(word), vec)
+		}
+	}
+	if opts.TrimWord {
+		next := fn
+		fn = func(word string, vec Vector) {
+			if word = trimWord(word); word != "" {
+				next(word, vec)
+			}
+		}
+	}
+	if binary {
+		return scanWord2VecBinary(r, opts, fn)
+	}
+	return scanTextVectors(r, opts, fn)
+}
+
+// scanTextVectors parses a whitespace-separated text model. Blank lines are
+// skipped wherever they appear, a header is looked for on the first non-blank
+// line, and components may be separated by any run of spaces and tabs. A BOM
+// and \r\n endings are dropped by the line scanner; testdata/quirks.vec
+// combines all of these.
+func scanTextVectors(r io.Reader, opts *loadOptions, fn func(word string, vec Vector)) error {
+	scanner := newLineScanner(r)
+	// The first vector fixes the dimension every other line must match
+	dim := -1
+	lineNum, malformed, skipped, invalid, loaded := 0, 0, 0, 0, 0
+	headerCount := -1
+	// The header, if any, is the first line with anything on it
+	started := false
+	progress := newProgress("lines loaded:", progressInterval, 0)
+	// Without a header, the line count is guessed from how long the first
+	// lines are, when the input is a plain file whose size is known
+	var fileSize, bytesSeen int64
+	if file, ok := r.(*os.File); ok && showProgress {
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+			fileSize = info.Size()
+		}
+	}
+	// failed is the first error consume ran into; it ignores every line after
+	// it, and stop tells the reading loop to give up too
+	var failed error
+	var stop int32
+	fail := func(err error) {
+		failed = withExitCode(exitBadFormat, err)
+		atomic.StoreInt32(&stop, 1)
+	}
+	// consume takes the parsed lines in file order, whichever goroutine parsed them
+	consume := func(line parsedLine) {
+		if failed != nil {
+			return
+		}
+		// Blank lines and bare words carry no vector
+		if line.word == "" || line.fields == 0 {
+			logger.Verbosef("... skipping line %d: no vector.\n", line.num)
+			skipped++
+			return
+		}
+		if dim == -1 {
+			if err := opts.checkExpectedDim(line.fields, fmt.Sprintf("first vector (line %d)", line.num)); err != nil {
+				fail(err)
+				return
+			}
+			dim = line.fields
+		} else if line.fields != dim {
+			if opts.Strict {
+				fail(fmt.Errorf("line %d (%q) has %d dimensions, expected %d", line.num, line.word, line.fields, dim))
+				return
+			}
+			logger.Verbosef("... skipping line %d (%q): %d dimensions, expected %d.\n", line.num, line.word, line.fields, dim)
+			malformed++
+			return
+		}
+		if line.err != nil {
+			if opts.Strict {
+				fail(fmt.Errorf("line %d (%q): %v", line.num, line.word, line.err))
+				return
+			}
+			logger.Verbosef("... skipping line %d (%q): %v.\n", line.num, line.word, line.err)
+			invalid++
+			return
+		}
+		fn(line.word, line.vec)
+		loaded++
+	}
+	var pool *parsePool
+	if opts.LoadWorkers > 1 {
+		pool = newParsePool(opts.LoadWorkers, opts.TabWord, consume)
+	}
+	for atomic.LoadInt32(&stop) == 0 && scanner.Scan() {
+		lineNum++
+		if fileSize > 0 && headerCount < 0 {
+			bytesSeen += int64(len(scanner.Bytes())) + 1
+			if lineNum == progressEstimateLines {
+				progress.setTotal(int(fileSize*int64(lineNum)/bytesSeen), true)
+			}
+		}
+		progress.tick()
+		if !started && strings.TrimSpace(scanner.Text()) != "" {
+			started = true
+			// fastText .vec files start with "<count> <dim>", which would
+			// otherwise load as a word with a one-element vector
+			if count, headerDim, ok := parseHeader(scanner.Text()); ok {
+				if err := opts.checkExpectedDim(headerDim, "header"); err != nil {
+					return err
+				}
+				headerCount, dim = count, headerDim
+				progress.setTotal(count, false)
+				logger.Printf("-> Found a header for %d vectors of dimension %d.\n", count, headerDim)
+				continue
+			}
+			if opts.SkipHeader {
+				continue
+			}
+		}
+		if pool != nil {
+			pool.add(lineNum, scanner.Text())
+		} else {
+			consume(parseTextLine(lineNum, scanner.Text(), opts.TabWord))
+		}
+	}
+	if pool != nil {
+		pool.finish()
+	}
+	if failed != nil {
+		return failed
+	}
+	if err := scanError(scanner, "GloVe file"); err != nil {
+		return err
+	}
+	if headerCount >= 0 && headerCount != loaded {
+		if opts.Strict {
+			return withExitCode(exitBadFormat, fmt.Errorf("header records %d vectors but %d were loaded", headerCount, loaded))
+		}
+		logger.Printf("Warning: header records %d vectors but %d were loaded.\n", headerCount, loaded)
+	}
+	if skipped > 0 {
+		logger.Printf("-> Skipped %d blank or vectorless lines.\n", skipped)
+	}
+	if malformed > 0 {
+		logger.Printf("-> Skipped %d malformed lines whose dimension differs from %d.\n", malformed, dim)
+	}
+	if invalid > 0 {
+		logger.Printf("-> Skipped %d words with non-numeric, NaN or Inf components.\n", invalid)
+	}
+	return nil
+}
+
+// parsedLine is one text model line split and parsed by parseTextLine.
+type parsedLine struct {
+	num    int
+	word   string
+	fields int
+	vec    Vector
+	err    error
+}
+
+// parseTextLine splits and parses line number num of a text model; lines with
+// no word or no components are left unparsed, with fields 0 or vec nil.
+func parseTextLine(num int, text string, tabWord bool) parsedLine {
+	word, values := splitVectorLine(text, tabWord)
+	line := parsedLine{num: num, word: word, fields: len(values)}
+	if word != "" && len(values) > 0 {
+		line.vec, line.err = parseVectorFields(values)
+	}
+	return line
+}
+
+// parseBatchLines is how many lines a parsePool hands a worker at a time, which
+// keeps the channel traffic small next to the parsing itself.
+const parseBatchLines = 1024
+
+// parseBatch is a run of consecutive lines, parsed by one worker. done is
+// closed once parsed holds them.
+type parseBatch struct {
+	nums   []int
+	texts  []string
+	parsed []parsedLine
+	done   chan struct{}
+}
+
+// parsePool parses text model lines on several goroutines (see
+// loadOptions.LoadWorkers) but hands them to consume in file order, on a
+// single goroutine, so the first-dimension rule, duplicate handling and line
+// numbers in errors all behave exactly as in a sequential scan.
+type parsePool struct {
+	tabWord bool
+	current *parseBatch
+	jobs    chan *parseBatch
+	ordered chan *parseBatch
+	drained chan struct{}
+}
+
+func newParsePool(workers int, tabWord bool, consume func(parsedLine)) *parsePool {
+	p := &parsePool{
+		tabWord: tabWord,
+		jobs:    make(chan *parseBatch, 2*workers),
+		// Bounds how far reading runs ahead of consume, and so the memory held
+		ordered: make(chan *parseBatch, 2*workers),
+		drained: make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for batch := range p.jobs {
+				batch.parsed = make([]parsedLine, len(batch.texts))
+				for j, text := range batch.texts {
+					batch.parsed[j] = parseTextLine(batch.nums[j], text, tabWord)
+				}
+				close(batch.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(p.drained)
+		for batch := range p.ordered {
+			<-batch.done
+			for _, line := range batch.parsed {
+				consume(line)
+			}
+		}
+	}()
+	return p
+}
+
+// add queues line number num for parsing.
+func (p *parsePool) add(num int, text string) {
+	if p.current == nil {
+		p.current = &parseBatch{done: make(chan struct{})}
+	}
+	p.current.nums = append(p.current.nums, num)
+	p.current.texts = append(p.current.texts, text)
+	if len(p.current.texts) == parseBatchLines {
+		p.send()
+	}
+}
+
+func (p *parsePool) send() {
+	// Queued in order before any worker can finish it, so consume sees batches
+	// in the order they were read
+	p.ordered <- p.current
+	p.jobs <- p.current
+	p.current = nil
+}
+
+// finish parses the remaining lines and waits until consume has seen them all.
+func (p *parsePool) finish() {
+	if p.current != nil {
+		p.send()
+	}
+	close(p.jobs)
+	close(p.ordered)
+	<-p.drained
+}
+
+// gzipReadCloser closes both the gzip stream and the file underneath it.
+type gzipReadCloser struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (g gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// gzipWriteCloser flushes the gzip stream before closing the file underneath it.
+type gzipWriteCloser struct {
+	*gzip.Writer
+	file *atomicFile
+}
+
+func (g gzipWriteCloser) Close() error {
+	if err := g.Writer.Close(); err != nil {
+		g.file.abort()
+		return err
+	}
+	return g.file.Close()
+}
+
+// atomicFile is written under a temporary name in the destination directory and
+// only renamed into place by a successful Close, so an interrupted run leaves
+// either the previous file or the complete new one at path, never a partial one.
+type atomicFile struct {
+	*os.File
+	path string
+}
+
+func (f *atomicFile) Close() error {
+	pendingOutputs.remove(f)
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	if err := os.Rename(f.File.Name(), f.path); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	return nil
+}
+
+// abort discards the temporary file without touching the destination.
+func (f *atomicFile) abort() {
+	pendingOutputs.remove(f)
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
+
+// outputSet tracks the createOutput files that are neither closed nor aborted.
+type outputSet struct {
+	mu    sync.Mutex
+	files map[*atomicFile]bool
+}
+
+// pendingOutputs is what fatalf discards before exiting, since os.Exit skips
+// the deferred aborts that would otherwise clean up a failed write.
+var pendingOutputs = outputSet{files: make(map[*atomicFile]bool)}
+
+func (s *outputSet) add(f *atomicFile) {
+	s.mu.Lock()
+	s.files[f] = true
+	s.mu.Unlock()
+}
+
+func (s *outputSet) remove(f *atomicFile) {
+	s.mu.Lock()
+	delete(s.files, f)
+	s.mu.Unlock()
+}
+
+// abortAll aborts every pending file.
+func (s *outputSet) abortAll() {
+	s.mu.Lock()
+	files := make([]*atomicFile, 0, len(s.files))
+	for f := range s.files {
+		files = append(files, f)
+	}
+	s.mu.Unlock()
+	for _, f := range files {
+		f.abort()
+	}
+}
+
+// abortOutput discards a file from createOutput that failed part way, so what
+// was at its path before stays untouched.
+func abortOutput(w io.WriteCloser) {
+	switch f := w.(type) {
+	case *atomicFile:
+		f.abort()
+	case gzipWriteCloser:
+		f.file.abort()
+	}
+}
+
+// openInput opens filePath for reading, decompressing it on the fly if it ends in .gz.
+// A path of "-" reads from stdin, and an http(s) URL is downloaded (see openURL).
+func openInput(filePath string) (io.ReadCloser, error) {
+	if filePath == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	if isURL(filePath) {
+		return openURL(filePath)
+	}
+	file, err := openWithRetry(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(filePath, ".gz") {
+		return file, nil
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading gzip header of %s: %w", filePath, err)
+	}
+	return gzipReadCloser{Reader: gz, file: file}, nil
+}
+
+// isURL reports whether an input path is an http or https URL.
+func isURL(filePath string) bool {
+	return strings.HasPrefix(filePath, "http://") || strings.HasPrefix(filePath, "https://")
+}
+
+// openURL streams the body of a GET of rawURL, giving up after -http-timeout.
+// It is decompressed if the URL path ends in .gz or the server marks the body
+// as gzip-encoded without the transport having already decoded it.
+func openURL(rawURL string) (io.ReadCloser, error) {
+	client := &http.Client{Timeout: httpTimeout}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s: server answered %s", rawURL, resp.Status)
+	}
+	path := rawURL
+	if parsed, err := url.Parse(rawURL); err == nil {
+		path = parsed.Path
+	}
+	encoded := resp.Header.Get("Content-Encoding") == "gzip" && !resp.Uncompressed
+	if !strings.HasSuffix(path, ".gz") && !encoded {
+		return resp.Body, nil
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("reading gzip header of %s: %w", rawURL, err)
+	}
+	return gzipReadCloser{Reader: gz, file: resp.Body}, nil
+}
+
+// openRetryDelay is the wait before the first retry of a transient open error;
+// it doubles with each further attempt.
+const openRetryDelay = 200 * time.Millisecond
+
+// openWithRetry opens filePath, retrying up to openRetries times while the
+// failure looks transient. Missing files and permission errors won't fix
+// themselves, so they are returned straight away.
+func openWithRetry(filePath string) (*os.File, error) {
+	delay := openRetryDelay
+	for attempt := 0; ; attempt++ {
+		file, err := os.Open(filePath)
+		if err == nil || attempt >= openRetries || !transientOpenError(err) {
+			if err != nil && attempt > 0 {
+				err = fmt.Errorf("%w (gave up after %d attempts)", err, attempt+1)
+			}
+			return file, err
+		}
+		logger.Printf("Warning: opening %s failed (%v); retrying in %v...\n", filePath, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// transientOpenError reports whether err is the kind of I/O failure, mostly
+// seen on network filesystems, that may succeed when tried again.
+func transientOpenError(err error) bool {
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+		return false
+	}
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.EAGAIN, syscall.EINTR, syscall.EBUSY, syscall.ETIMEDOUT, syscall.ESTALE} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameFile reports whether a and b name the same file, following symlinks.
+// Paths that don't exist yet are compared by their absolute form.
+func sameFile(a, b string) bool {
+	if a == "" || b == "" || a == "-" || b == "-" {
+		return false
+	}
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	if errA == nil && errB == nil {
+		return os.SameFile(infoA, infoB)
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// checkOutputPath refuses an output path that is also one of the inputs. The
+// atomic write would stop the read from seeing a truncated file, but replacing
+// the source is never what was meant.
+func checkOutputPath(output string, inputs ...string) error {
+	for _, input := range inputs {
+		if sameFile(input, output) {
+			return fmt.Errorf("-output %s is the input file %s, which would be overwritten; choose another path", output, input)
+		}
+	}
+	return nil
+}
+
+// createOutput creates filePath for writing, compressing it on the fly if it ends in .gz.
+// The data only appears at filePath once Close succeeds (see atomicFile).
+func createOutput(filePath string) (io.WriteCloser, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp uses 0600, which would make results unreadable to other tools
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	file := &atomicFile{File: tmp, path: filePath}
+	pendingOutputs.add(file)
+	if !strings.HasSuffix(filePath, ".gz") {
+		return file, nil
+	}
+	return gzipWriteCloser{Writer: gzip.NewWriter(file), file: file}, nil
+}
+
+// scanWord2VecBinary parses the binary word2vec format: a "<count> <dim>" text
+// header, then per word its text followed by a space and dim little-endian float32s.
+func scanWord2VecBinary(r io.Reader, opts *loadOptions, fn func(word string, vec Vector)) error {
+	reader := bufio.NewReader(r)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return withExitCode(exitBadFormat, fmt.Errorf("reading word2vec header: %w", err))
+	}
+	var count, dim int
+	if _, err := fmt.Sscanf(header, "%d %d", &count, &dim); err != nil || count < 0 || dim <= 0 {
+		return withExitCode(exitBadFormat, fmt.Errorf("malformed word2vec header %q", strings.TrimSpace(header)))
+	}
+	if err := opts.checkExpectedDim(dim, "word2vec header"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4*dim)
+	invalid := 0
+	progress := newProgress("vectors loaded:", progressInterval, count)
+	for i := 0; i < count; i++ {
+		word, err := reader.ReadString(' ')
+		if err != nil {
+			return withExitCode(exitBadFormat, fmt.Errorf("reading word %d of %d: %w", i+1, count, err))
+		}
+		// Most writers put a newline after each vector, which ends up in front of the next word
+		word = strings.TrimLeft(strings.TrimSuffix(word, " "), "\n")
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return withExitCode(exitBadFormat, fmt.Errorf("reading vector for %q: %w", word, err))
+		}
+		vec := make(Vector, dim)
+		finite := true
+		for j := range vec {
+			vec[j] = float64(math.Float32frombits(binary.LittleEndian.Uint32(buf[4*j:])))
+			finite = finite && !math.IsNaN(vec[j]) && !math.IsInf(vec[j], 0)
+		}
+		progress.tick()
+		if !finite {
+			if opts.Strict {
+				return withExitCode(exitBadFormat, fmt.Errorf("vector for %q has NaN or Inf components", word))
+			}
+			invalid++
+			continue
+		}
+		fn(word, vec)
+	}
+	if invalid > 0 {
+		logger.Printf("-> Skipped %d words with NaN or Inf components.\n", invalid)
+	}
+	return nil
+}
+
+// lineWord returns the word a raw vector line is for, without parsing the vector.
+func lineWord(line string) string {
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// trimWord trims word and collapses every run of Unicode whitespace inside it
+// (such as U+00A0, the non-breaking space) to a single ASCII space.
+func trimWord(word string) string {
+	return strings.Join(strings.Fields(word), " ")
+}
+
+// splitVectorLine splits a text vector line into its word and component tokens.
+// With tabWord the word runs up to the first tab, otherwise to the first space or tab.
+func splitVectorLine(line string, tabWord bool) (string, []string) {
+	if tabWord {
+		word, rest, _ := strings.Cut(line, "\t")
+		return word, strings.Fields(rest)
+	}
+	// The word ends at ASCII whitespace only, like lineWord, so a non-breaking
+	// space stays part of it
+	line = strings.TrimLeft(line, " \t")
+	word := lineWord(line)
+	return word, strings.Fields(line[len(word):])
+}
+
+// parseVectorFields parses the components of a vector line. Non-numeric tokens and
+// NaN/Inf are rejected rather than coerced, since one of them poisons every score.
+func parseVectorFields(fields []string) (Vector, error) {
+	vec := make(Vector, len(fields))
+	for i, v := range fields {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("component %d (%q) is not a number", i+1, v)
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("component %d (%q) is not finite", i+1, v)
+		}
+		vec[i] = f
+	}
+	return vec, nil
+}
+
+// parseHeader recognizes a "<count> <dim>" header line as written by word2vec and fastText.
+func parseHeader(line string) (count, dim int, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+	count, err1 := strconv.Atoi(fields[0])
+	dim, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil || count < 0 || dim <= 0 {
+		return 0, 0, false
+	}
+	return count, dim, true
+}
+
+// vectorDim returns the dimension of the vectors in gloveMap, or 0 if it is empty.
+func vectorDim(gloveMap map[string]Vector) int {
+	for _, vec := range gloveMap {
+		return len(vec)
+	}
+	return 0
+}
+
+// vocabOptions controls how vocabulary files are read.
+type vocabOptions struct {
+	// Lowercase folds every vocabulary word to lower case.
+	Lowercase bool
+	// Filter, if set, drops words (after folding) that it doesn't match.
+	Filter *regexp.Regexp
+	// MinFreq, if positive, drops words whose count is below it. Words listed
+	// without a count are kept, since their frequency is unknown.
+	MinFreq int
+	// MaxWords, if positive, fails the load as soon as more distinct words than
+	// that have been read, before a wrong file can use up memory. Words dropped
+	// by Filter don't count towards it.
+	MaxWords int
+}
+
+// loadVocabulary reads one word per line. A line may also be "word<TAB>count",
+// in which case the count is returned too (summed over words that fold together);
+// counts is empty when the file has none. Blank lines and vocabComment lines
+// are skipped, so a hand-kept file can be split into annotated sections.
+func loadVocabulary(filePath string, opts vocabOptions) (map[string]bool, map[string]int, error) {
+	file, err := openInput(filePath)
+	if err != nil {
+		return nil, nil, withExitCode(exitMissingVocab, fmt.Errorf("opening vocabulary file: %w", err))
+	}
+	defer file.Close()
+	return parseVocabularyReader(file, filePath, opts)
+}
+
+// parseVocabularyReader is loadVocabulary for an already open reader; name
+// only identifies it in error messages.
+func parseVocabularyReader(r io.Reader, name string, opts vocabOptions) (map[string]bool, map[string]int, error) {
+	vocab := make(map[string]bool)
+	counts := make(map[string]int)
+	// counted marks words with a count field, which a count of 0 doesn't show
+	counted := make(map[string]bool)
+	scanner := newLineScanner(r)
+	lineNum, filtered := 0, 0
+	for scanner.Scan() {
+		lineNum++
+		word := strings.TrimSpace(scanner.Text())
+		if vocabComment != "" && strings.HasPrefix(word, vocabComment) {
+			continue
+		}
+		count, hasCount := 0, false
+		if i := strings.LastIndexByte(word, '\t'); i >= 0 {
+			n, err := strconv.Atoi(strings.TrimSpace(word[i+1:]))
+			if err != nil || n < 0 {
+				return nil, nil, withExitCode(exitBadFormat, fmt.Errorf("line %d of %s has an invalid count %q", lineNum, name, word[i+1:]))
+			}
+			word, count, hasCount = strings.TrimSpace(word[:i]), n, true
+		}
+		if opts.Lowercase {
+			word = strings.ToLower(word)
+		}
+		if word != "" && opts.Filter != nil && !opts.Filter.MatchString(word) {
+			filtered++
+			continue
+		}
+		if word != "" {
+			vocab[word] = true
+			if opts.MaxWords > 0 && len(vocab) > opts.MaxWords {
+				return nil, nil, fmt.Errorf("%s has more than %d distinct words by line %d; check it is the vault vocabulary, or raise -max-vocab", name, opts.MaxWords, lineNum)
+			}
+			if count > 0 {
+				counts[word] += count
+			}
+			if hasCount {
+				counted[word] = true
+			}
+		}
+	}
+	if err := scanError(scanner, "vocabulary file"); err != nil {
+		return nil, nil, err
+	}
+	if opts.Filter != nil {
+		logger.Printf("-> Filter %q dropped %d vocabulary lines.\n", opts.Filter, filtered)
+	}
+	if opts.MinFreq > 0 {
+		if len(counted) == 0 {
+			logger.Printf("Warning: %s has no word<TAB>count lines, so -min-freq keeps every word.\n", name)
+		}
+		// Counts are compared after folding, so "Go" and "go" add up first
+		dropped := 0
+		for word := range counted {
+			if counts[word] < opts.MinFreq {
+				delete(vocab, word)
+				delete(counts, word)
+				dropped++
+			}
+		}
+		logger.Printf("-> Dropped %d words seen fewer than %d times.\n", dropped, opts.MinFreq)
+	}
+	return vocab, counts, nil
+}
+
+// Metric scores how close two vectors are.
+type Metric struct {
+	Name string
+	// Score compares two vectors given their precomputed L2 norms (see vectorNorms),
+	// which keeps the per-pair work in hot loops down to a single pass.
+	Score func(vecA, vecB Vector, normA, normB float64) float64
+	// LowerIsCloser is set for distances, where a smaller score means a closer vector.
+	LowerIsCloser bool
+}
+
+const metricHelp = "Closeness metric: 'cosine', 'dot' or 'euclidean'."
+
+func parseMetric(name string) (Metric, error) {
+	switch name {
+	case "cosine":
+		return Metric{Name: name, Score: cosineWithNorms}, nil
+	case "dot":
+		return Metric{Name: name, Score: func(vecA, vecB Vector, _, _ float64) float64 {
+			return dotProduct(vecA, vecB)
+		}}, nil
+	case "euclidean":
+		return Metric{Name: name, Score: func(vecA, vecB Vector, _, _ float64) float64 {
+			return euclideanDistance(vecA, vecB)
+		}, LowerIsCloser: true}, nil
+	}
+	return Metric{}, fmt.Errorf("unknown metric %q (expected 'cosine', 'dot' or 'euclidean')", name)
+}
+
+// closer reports whether score a is closer than score b under this metric.
+func (m Metric) closer(a, b float64) bool {
+	if m.LowerIsCloser {
+		return a < b
+	}
+	return a > b
+}
+
+// ranksBefore orders neighbors closest first, breaking score ties by word so
+// the neighbors kept at a topN boundary don't depend on map iteration order.
+func (m Metric) ranksBefore(a, b Similarity) bool {
+	if a.Score != b.Score {
+		return m.closer(a.Score, b.Score)
+	}
+	return a.Word < b.Word
+}
+
+// passes reports whether score clears the -threshold. For distances the threshold
+// is a maximum, and a non-positive one disables the check.
+func (m Metric) passes(score, threshold float64) bool {
+	if m.LowerIsCloser {
+		return threshold <= 0 || score <= threshold
+	}
+	return score >= threshold
+}
+
+func dotProduct(vecA, vecB Vector) float64 {
+	var dot float64
+	for i := range vecA {
+		dot += vecA[i] * vecB[i]
+	}
+	return dot
+}
+
+func euclideanDistance(vecA, vecB Vector) float64 {
+	var sum float64
+	for i := range vecA {
+		d := vecA[i] - vecB[i]
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+func l2Norm(vec Vector) float64 {
+	var sum float64
+	for _, v := range vec {
+		sum += v * v
+	}
+	return math.Sqrt(sum)
+}
+
+// vectorNorms precomputes the L2 norm of every vector in gloveMap.
+func vectorNorms(gloveMap map[string]Vector) map[string]float64 {
+	norms := make(map[string]float64, len(gloveMap))
+	for word, vec := range gloveMap {
+		norms[word] = l2Norm(vec)
+	}
+	return norms
+}
+
+// cosineWithNorms is cosineSimilarity for callers that already know both norms.
+func cosineWithNorms(vecA, vecB Vector, normA, normB float64) float64 {
+	if normA == 0 || normB == 0 {
+		return 0.0
+	}
+	return dotProduct(vecA, vecB) / (normA * normB)
+}
+
+func cosineSimilarity(vecA, vecB Vector) float64 {
+	var dotProduct, normA, normB float64
+	for i := range vecA {
+		dotProduct += vecA[i] * vecB[i]
+		normA += vecA[i] * vecA[i]
+		normB += vecB[i] * vecB[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0.0
+	}
+	return dotProduct / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// rankNeighbors returns the topN words of gloveMap closest to target under metric,
+// skipping any word in exclude; a topN below 1 returns none.
+func rankNeighbors(target Vector, gloveMap map[string]Vector, norms map[string]float64, exclude map[string]bool, topN int, metric Metric) []Similarity {
+	if topN < 1 {
+		return nil
+	}
+	targetNorm := l2Norm(target)
+	similarities := make([]Similarity, 0, len(gloveMap))
+	for word, vec := range gloveMap {
+		if exclude[word] {
+			continue
+		}
+		similarities = append(similarities, Similarity{Word: word, Score: metric.Score(target, vec, targetNorm, norms[word])})
+	}
+	sort.Slice(similarities, func(i, j int) bool {
+		return metric.ranksBefore(similarities[i], similarities[j])
+	})
+	if len(similarities) > topN {
+		similarities = similarities[:topN]
+	}
+	return similarities
+}
+
+// neighborOptions controls how neighbors are selected for each vault word.
+type neighborOptions struct {
+	TopN      int
+	Threshold float64
+	Metric    Metric
+	// Workers is the number of search goroutines; 0 means one per CPU.
+	Workers int
+	// MinNorm drops near-zero candidate vectors, which are usually noise for rare tokens.
+	MinNorm float64
+	// Subword gives out-of-vocabulary vault words the average vector of their
+	// hyphen/underscore-separated parts, and Phrase does the same for
+	// space-separated phrases (see compoundParts).
+	Subword bool
+	Phrase  bool
+	// Percentile, if positive, only keeps neighbors closer than that percentage
+	// of all candidates of the vault word. It needs every score of the word, not
+	// just the running top N, so the streaming search doesn't support it.
+	Percentile float64
+	// Approx, if positive, only scores the candidates sharing a bucket with the
+	// vault word in any of that many random-hyperplane hash tables (see
+	// lshIndex) instead of the whole model. Results are then approximate: more
+	// tables find more of the true neighbors, but take longer.
+	Approx int
+	// ExternalOnly skips candidates that are vault words themselves, so the
+	// neighbors found (and reported) are only the words the vault pulls in.
+	ExternalOnly bool
+	// vault is the set ExternalOnly skips when the words searched from aren't
+	// the vault words themselves, as on Prune's later -depth hops.
+	vault map[string]bool
+	// Adaptive only keeps neighbors past mean + AdaptiveK*stddev of the vault
+	// word's scores against every candidate (mean - AdaptiveK*stddev for
+	// distances), a floor that rises with the density around the word. Like
+	// Percentile, it needs every score, so the streaming search doesn't support it.
+	Adaptive  bool
+	AdaptiveK float64
+	// ExcludeNumeric skips candidates made only of digits, punctuation and
+	// symbols ("1999", "3.14", "--"), and MinWordLen, if positive, those with
+	// fewer runes than it.
+	ExcludeNumeric bool
+	MinWordLen     int
+}
+
+// filtersTokens reports whether any token filter of rejectsToken is set.
+func (o neighborOptions) filtersTokens() bool {
+	return o.ExcludeNumeric || o.MinWordLen > 0
+}
+
+// rejectsToken reports whether word is kept out of the neighbor candidates by
+// ExcludeNumeric or MinWordLen.
+func (o neighborOptions) rejectsToken(word string) bool {
+	if o.MinWordLen > 0 && utf8.RuneCountInString(word) < o.MinWordLen {
+		return true
+	}
+	if !o.ExcludeNumeric {
+		return false
+	}
+	for _, r := range word {
+		if !unicode.IsNumber(r) && !unicode.IsPunct(r) && !unicode.IsSymbol(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// composes reports whether missing vault words may be built from their parts.
+func (o neighborOptions) composes() bool {
+	return o.Subword || o.Phrase
+}
+
+// compoundParts splits an out-of-vocabulary vault word into the parts whose
+// average vector stands in for it: on whitespace with Phrase ("machine learning"),
+// on hyphens and underscores with Subword ("machine_learning", "state-of-the-art").
+func (o neighborOptions) compoundParts(word string) []string {
+	return strings.FieldsFunc(word, func(r rune) bool {
+		return (o.Phrase && unicode.IsSpace(r)) || (o.Subword && (r == '_' || r == '-'))
+	})
+}
+
+// workerCount resolves the configured worker count, never exceeding the number
+// of jobs so tiny vaults don't spawn idle goroutines.
+func (o neighborOptions) workerCount(jobs int) int {
+	n := o.Workers
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	if jobs > 0 && n > jobs {
+		n = jobs
+	}
+	return n
+}
+
+// findNeighborsConcurrently returns each vault word's TopN neighbors, closest first,
+// plus the sorted vault words that have no vector in fullGloveMap and, apart
+// from those, the sorted vault words whose vector is all zeros. A zero vector
+// scores the same against everything, so those words aren't searched from.
+// Last come the sorted vault words searched from a vector averaged from their
+// parts (see neighborOptions.Subword), which have no line in the model.
+func findNeighborsConcurrently(vaultVocab map[string]bool, fullGloveMap map[string]Vector, opts neighborOptions) (map[string][]Similarity, []string, []string, []string) {
+	topN, threshold, metric := opts.TopN, opts.Threshold, opts.Metric
+	norms := vectorNorms(fullGloveMap)
+	if opts.MinNorm > 0 {
+		filtered := 0
+		for _, norm := range norms {
+			if norm < opts.MinNorm {
+				filtered++
+			}
+		}
+		logger.Printf("-> Ignoring %d candidate vectors with L2 norm below %g.\n", filtered, opts.MinNorm)
+	}
+	// Looked up once per model word, rather than rechecked for every vault word
+	var rejected map[string]bool
+	if opts.filtersTokens() {
+		rejected = make(map[string]bool)
+		for word := range fullGloveMap {
+			if opts.rejectsToken(word) {
+				rejected[word] = true
+			}
+		}
+		logger.Printf("-> Ignoring %d numeric or too short candidate words.\n", len(rejected))
+	}
+	external := vaultVocab
+	if opts.vault != nil {
+		external = opts.vault
+	}
+	numWorkers := opts.workerCount(len(vaultVocab))
+	var index *lshIndex
+	if opts.Approx > 0 {
+		index = newLSHIndex(fullGloveMap, opts.Approx, numWorkers)
+		logger.Printf("-> Approximate search: %d hash tables of %d-bit signatures, averaging %.0f candidates per table.\n", opts.Approx, index.bits, index.meanBucketSize())
+	}
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	neighborsByWord := make(map[string][]Similarity)
+	var missing, zero, composed []string
+	jobs := make(chan string, len(vaultVocab))
+	progress := newProgress("vault words searched:", len(vaultVocab)/20, len(vaultVocab))
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Every candidate score of the current vault word, for -percentile
+			var scores []float64
+			// Words already scored for the current vault word, for -approx
+			seen := make(map[string]bool)
+			for vaultWord := range jobs {
+				progress.tick()
+				vaultVec, ok := fullGloveMap[vaultWord]
+				vaultNorm := norms[vaultWord]
+				if !ok && opts.composes() {
+					if vaultVec, ok = compoundVector(vaultWord, opts.compoundParts(vaultWord), fullGloveMap); ok {
+						vaultNorm = l2Norm(vaultVec)
+						mutex.Lock()
+						composed = append(composed, vaultWord)
+						mutex.Unlock()
+					}
+				}
+				if !ok {
+					mutex.Lock()
+					missing = append(missing, vaultWord)
+					mutex.Unlock()
+					continue
+				}
+				if vaultNorm == 0 {
+					mutex.Lock()
+					zero = append(zero, vaultWord)
+					mutex.Unlock()
+					continue
+				}
+				top := newTopNHeap(topN, metric)
+				scores = scores[:0]
+				// Running sums of every candidate score, for -adaptive
+				var sum, sumSquares float64
+				candidates := 0
+				score := func(gloveWord string, gloveVec Vector) {
+					if gloveWord != vaultWord && norms[gloveWord] >= opts.MinNorm && !rejected[gloveWord] && !(opts.ExternalOnly && external[gloveWord]) {
+						sim := metric.Score(vaultVec, gloveVec, vaultNorm, norms[gloveWord])
+						if opts.Percentile > 0 {
+							scores = append(scores, sim)
+						}
+						if opts.Adaptive {
+							sum += sim
+							sumSquares += sim * sim
+							candidates++
+						}
+						if metric.passes(sim, threshold) {
+							top.offer(Similarity{Word: gloveWord, Score: sim})
+						}
+					}
+				}
+				if index != nil {
+					for word := range seen {
+						delete(seen, word)
+					}
+					index.forEachCandidate(vaultVec, func(gloveWord string) {
+						if !seen[gloveWord] {
+							seen[gloveWord] = true
+							score(gloveWord, fullGloveMap[gloveWord])
+						}
+					})
+				} else {
+					for gloveWord, gloveVec := range fullGloveMap {
+						score(gloveWord, gloveVec)
+					}
+				}
+				found := top.sorted()
+				if opts.Percentile > 0 && len(scores) > 0 {
+					// The top N are the closest candidates, so cutting them at the
+					// percentile is the same as taking the top N past the cut
+					found = closerThan(found, percentileCutoff(scores, opts.Percentile, metric), metric)
+				}
+				if opts.Adaptive && candidates > 0 {
+					mean := sum / float64(candidates)
+					stddev := math.Sqrt(math.Max(0, sumSquares/float64(candidates)-mean*mean))
+					cutoff := mean + opts.AdaptiveK*stddev
+					if metric.LowerIsCloser {
+						cutoff = mean - opts.AdaptiveK*stddev
+					}
+					found = closerThan(found, cutoff, metric)
+				}
+				mutex.Lock()
+				neighborsByWord[vaultWord] = found
+				mutex.Unlock()
+			}
+		}()
+	}
+	for word := range vaultVocab {
+		jobs <- word
+	}
+	close(jobs)
+	wg.Wait()
+	if opts.composes() {
+		logger.Printf("-> Built averaged vectors for %d out-of-vocabulary vault words from their parts.\n", len(composed))
+	}
+	sort.Strings(missing)
+	sort.Strings(zero)
+	sort.Strings(composed)
+	return neighborsByWord, missing, zero, composed
+}
+
+// lshIndex buckets vectors by which side of a few random hyperplanes they fall
+// on. Vectors at a small angle usually land in the same bucket, so the words
+// sharing a vault word's bucket in any table stand in for the whole model.
+type lshIndex struct {
+	bits int
+	// planes[t] holds the bits hyperplane normals of table t.
+	planes  [][]Vector
+	buckets []map[uint32][]string
+}
+
+// lshBucketTarget is roughly how many words each bucket should hold; the
+// signature length is picked from the model size to get there.
+const lshBucketTarget = 1000
+
+// newLSHIndex hashes every vector of gloveMap into tables hash tables, using
+// up to workers goroutines. The hyperplanes come from a fixed seed, so repeated
+// runs over the same model find the same neighbors.
+func newLSHIndex(gloveMap map[string]Vector, tables, workers int) *lshIndex {
+	bits := 1
+	for bits < 30 && len(gloveMap)>>bits > lshBucketTarget {
+		bits++
+	}
+	dim := vectorDim(gloveMap)
+	rng := rand.New(rand.NewSource(1))
+	idx := &lshIndex{bits: bits, planes: make([][]Vector, tables), buckets: make([]map[uint32][]string, tables)}
+	for t := range idx.planes {
+		idx.planes[t] = make([]Vector, bits)
+		for b := range idx.planes[t] {
+			plane := make(Vector, dim)
+			for i := range plane {
+				plane[i] = rng.NormFloat64()
+			}
+			idx.planes[t][b] = plane
+		}
+		idx.buckets[t] = make(map[uint32][]string)
+	}
+
+	// Hashing costs tables*bits dot products per word, so it is split across
+	// workers; filling the buckets afterwards is cheap
+	words := make([]string, 0, len(gloveMap))
+	for word := range gloveMap {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	signatures := make([]uint32, len(words)*tables)
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	chunk := (len(words) + workers - 1) / workers
+	for start := 0; start < len(words); start += chunk {
+		end := start + chunk
+		if end > len(words) {
+			end = len(words)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				for t := 0; t < tables; t++ {
+					signatures[i*tables+t] = idx.signature(t, gloveMap[words[i]])
+				}
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	for i, word := range words {
+		for t := 0; t < tables; t++ {
+			key := signatures[i*tables+t]
+			idx.buckets[t][key] = append(idx.buckets[t][key], word)
+		}
+	}
+	return idx
+}
+
+// signature sets one bit per hyperplane of table t that vec lies above.
+func (idx *lshIndex) signature(t int, vec Vector) uint32 {
+	var key uint32
+	for b, plane := range idx.planes[t] {
+		if dotProduct(plane, vec) >= 0 {
+			key |= 1 << b
+		}
+	}
+	return key
+}
+
+// forEachCandidate calls fn for every word sharing a bucket with vec in any
+// table. A word in several of those buckets is passed once per bucket.
+func (idx *lshIndex) forEachCandidate(vec Vector, fn func(word string)) {
+	for t, buckets := range idx.buckets {
+		for _, word := range buckets[idx.signature(t, vec)] {
+			fn(word)
+		}
+	}
+}
+
+// meanBucketSize is the average number of words per non-empty bucket.
+func (idx *lshIndex) meanBucketSize() float64 {
+	words, buckets := 0, 0
+	for _, table := range idx.buckets {
+		for _, bucket := range table {
+			words += len(bucket)
+		}
+		buckets += len(table)
+	}
+	if buckets == 0 {
+		return 0
+	}
+	return float64(words) / float64(buckets)
+}
+
+// findNeighborsStreaming is the -lowmem counterpart of findNeighborsConcurrently.
+// The first pass over inputFile keeps only the vault words' vectors; the second
+// scores every model vector against them as it streams past, so memory stays
+// proportional to the vault rather than to the model.
+func findNeighborsStreaming(inputFile string, loadOpts *loadOptions, vaultVocab map[string]bool, opts neighborOptions) (map[string][]Similarity, []string, []string, []string, error) {
+	topN, threshold, metric := opts.TopN, opts.Threshold, opts.Metric
+	vaultVectors := make(map[string]Vector)
+	// With -oov=subword or -phrase the first pass also keeps the parts of every vault word
+	partVectors := make(map[string]Vector)
+	parts := make(map[string]bool)
+	if opts.composes() {
+		for word := range vaultVocab {
+			for _, part := range opts.compoundParts(word) {
+				parts[part] = true
+			}
+		}
+	}
+	err := readVectors(inputFile, loadOpts, func(word string, vec Vector) {
+		if vaultVocab[word] {
+			vaultVectors[word] = vec
+		}
+		if parts[word] {
+			partVectors[word] = vec
+		}
+	})
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	logger.Printf("-> Found vectors for %d of %d vault words.\n", len(vaultVectors), len(vaultVocab))
+	var composed []string
+	if opts.composes() {
+		for word := range vaultVocab {
+			if _, ok := vaultVectors[word]; ok {
+				continue
+			}
+			if vec, ok := compoundVector(word, opts.compoundParts(word), partVectors); ok {
+				vaultVectors[word] = vec
+				composed = append(composed, word)
+			}
+		}
+		sort.Strings(composed)
+		logger.Printf("-> Built averaged vectors for %d out-of-vocabulary vault words from their parts.\n", len(composed))
+	}
+	var missing []string
+	for word := range vaultVocab {
+		if _, ok := vaultVectors[word]; !ok {
+			missing = append(missing, word)
+		}
+	}
+	sort.Strings(missing)
+	vaultNorms := vectorNorms(vaultVectors)
+	var zero []string
+	for word, norm := range vaultNorms {
+		if norm == 0 {
+			zero = append(zero, word)
+			delete(vaultVectors, word)
+		}
+	}
+	sort.Strings(zero)
+
+	type candidate struct {
+		word string
+		vec  Vector
+	}
+	var wg sync.WaitGroup
+	var filtered int64
+	jobs := make(chan candidate, 1024)
+	// Jobs here are model lines, so there is no small upper bound to clamp to
+	numWorkers := opts.workerCount(0)
+	// Each worker keeps its own per-vault-word top-N so the hot loop needs no locking
+	bests := make([]map[string]*topNHeap, numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		best := make(map[string]*topNHeap, len(vaultVectors))
+		for vaultWord := range vaultVectors {
+			best[vaultWord] = newTopNHeap(topN, metric)
+		}
+		bests[i] = best
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				if (opts.ExternalOnly && vaultVocab[c.word]) || opts.rejectsToken(c.word) {
+					continue
+				}
+				norm := l2Norm(c.vec)
+				if norm < opts.MinNorm {
+					atomic.AddInt64(&filtered, 1)
+					continue
+				}
+				for vaultWord, vaultVec := range vaultVectors {
+					if c.word == vaultWord {
+						continue
+					}
+					sim := metric.Score(vaultVec, c.vec, vaultNorms[vaultWord], norm)
+					if metric.passes(sim, threshold) {
+						best[vaultWord].offer(Similarity{Word: c.word, Score: sim})
+					}
+				}
+			}
+		}()
+	}
+	err = readVectors(inputFile, loadOpts, func(word string, vec Vector) {
+		jobs <- candidate{word: word, vec: vec}
+	})
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if opts.MinNorm > 0 {
+		logger.Printf("-> Ignored %d candidate vectors with L2 norm below %g.\n", filtered, opts.MinNorm)
+	}
+
+	neighborsByWord := make(map[string][]Similarity, len(vaultVectors))
+	for vaultWord := range vaultVectors {
+		merged := newTopNHeap(topN, metric)
+		for _, best := range bests {
+			for _, sim := range best[vaultWord].items {
+				merged.offer(sim)
+			}
+		}
+		neighborsByWord[vaultWord] = merged.sorted()
+	}
+	return neighborsByWord, missing, zero, composed, nil
+}
+
+// closerThan filters found, in place, down to the neighbors at least as close
+// as cutoff.
+func closerThan(found []Similarity, cutoff float64, metric Metric) []Similarity {
+	kept := found[:0]
+	for _, sim := range found {
+		if !metric.closer(cutoff, sim.Score) {
+			kept = append(kept, sim)
+		}
+	}
+	return kept
+}
+
+// percentileCutoff returns the score that only (100-p)% of scores are closer
+// than, reordering scores in the process.
+func percentileCutoff(scores []float64, p float64, metric Metric) float64 {
+	k := int(p / 100 * float64(len(scores)-1))
+	if metric.LowerIsCloser {
+		k = len(scores) - 1 - k
+	}
+	return selectKth(scores, k)
+}
+
+// selectKth returns the k-th smallest value (0-based) of values in linear
+// expected time, partially reordering values.
+func selectKth(values []float64, k int) float64 {
+	lo, hi := 0, len(values)-1
+	for lo < hi {
+		// Median-of-three pivot keeps already-sorted input from going quadratic
+		mid := lo + (hi-lo)/2
+		if values[mid] < values[lo] {
+			values[mid], values[lo] = values[lo], values[mid]
+		}
+		if values[hi] < values[lo] {
+			values[hi], values[lo] = values[lo], values[hi]
+		}
+		if values[hi] < values[mid] {
+			values[hi], values[mid] = values[mid], values[hi]
+		}
+		pivot := values[mid]
+		i, j := lo, hi
+		for i <= j {
+			for values[i] < pivot {
+				i++
+			}
+			for values[j] > pivot {
+				j--
+			}
+			if i <= j {
+				values[i], values[j] = values[j], values[i]
+				i++
+				j--
+			}
+		}
+		if k <= j {
+			hi = j
+		} else if k >= i {
+			lo = i
+		} else {
+			return values[k]
+		}
+	}
+	return values[k]
+}
+
+// neighborVotes counts how many distinct vault words list each neighbor.
+func neighborVotes(neighborsByWord map[string][]Similarity) map[string]int {
+	votes := make(map[string]int)
+	for _, neighbors := range neighborsByWord {
+		for _, n := range neighbors {
+			votes[n.Word]++
+		}
+	}
+	return votes
+}
+
+// neighborWeights gives each neighbor the highest vault frequency among the
+// words it is a neighbor of. Vault words without a count weigh 1.
+func neighborWeights(neighborsByWord map[string][]Similarity, counts map[string]int) map[string]int {
+	weights := make(map[string]int)
+	for vaultWord, neighbors := range neighborsByWord {
+		count := counts[vaultWord]
+		if count == 0 {
+			count = 1
+		}
+		for _, n := range neighbors {
+			if count > weights[n.Word] {
+				weights[n.Word] = count
+			}
+		}
+	}
+	return weights
+}
+
+// compoundVector averages the vectors of word's parts found in gloveMap.
+// It fails if word has no separators or none of its parts are known.
+func compoundVector(word string, parts []string, gloveMap map[string]Vector) (Vector, bool) {
+	var sum Vector
+	found := 0
+	for _, part := range parts {
+		vec, ok := gloveMap[part]
+		if !ok || part == word {
+			continue
+		}
+		if sum == nil {
+			sum = make(Vector, len(vec))
+		}
+		for i, v := range vec {
+			sum[i] += v
+		}
+		found++
+	}
+	if found == 0 {
+		return nil, false
+	}
+	for i := range sum {
+		sum[i] /= float64(found)
+	}
+	return sum, true
+}
+
+// bestScores collapses per-vault-word neighbor lists into each neighbor's best
+// score against any vault word.
+func bestScores(neighborsByWord map[string][]Similarity, metric Metric) map[string]float64 {
+	best := make(map[string]float64)
+	for _, similarities := range neighborsByWord {
+		for _, sim := range similarities {
+			if score, ok := best[sim.Word]; !ok || metric.closer(sim.Score, score) {
+				best[sim.Word] = sim.Score
+			}
+		}
+	}
+	return best
+}
+
+// decayedNeighbors is how many of its topN neighbors a vault word seen count
+// times keeps under -decay: topN / ln(count), rounded and at least 1. Counts up
+// to e (including missing ones) keep all topN.
+func decayedNeighbors(topN, count int) int {
+	scale := math.Log(float64(count))
+	if scale <= 1 {
+		return topN
+	}
+	n := int(math.Round(float64(topN) / scale))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// globalTopPairs keeps only the topN closest (vault word, neighbor) pairs of
+// neighborsByWord overall. Ties go to the alphabetically first pair, so the
+// selection doesn't depend on map order. Vault words keep their entry, possibly
+// empty, so they still count as found.
+func globalTopPairs(neighborsByWord map[string][]Similarity, topN int, metric Metric) map[string][]Similarity {
+	type pair struct {
+		source string
+		sim    Similarity
+	}
+	var pairs []pair
+	for source, similarities := range neighborsByWord {
+		for _, sim := range similarities {
+			pairs = append(pairs, pair{source, sim})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		a, b := pairs[i], pairs[j]
+		if a.sim.Score != b.sim.Score {
+			return metric.closer(a.sim.Score, b.sim.Score)
+		}
+		if a.source != b.source {
+			return a.source < b.source
+		}
+		return a.sim.Word < b.sim.Word
+	})
+	if len(pairs) > topN {
+		pairs = pairs[:topN]
+	}
+	kept := make(map[string][]Similarity, len(neighborsByWord))
+	for source := range neighborsByWord {
+		kept[source] = nil
+	}
+	// pairs is sorted closest first, so each list stays sorted too
+	for _, p := range pairs {
+		kept[p.source] = append(kept[p.source], p.sim)
+	}
+	return kept
+}
+
+// writeNeighborReport writes one source_word,neighbor_word,score CSV row per
+// neighbor, grouped by vault word in alphabetical order.
+func writeNeighborReport(outputFile string, neighborsByWord map[string][]Similarity) {
+	outFile, err := createOutput(outputFile)
+	if err != nil {
+		fatalf(exitFailure, "Error creating neighbor report: %v", err)
+	}
+	sources := make([]string, 0, len(neighborsByWord))
+	for word := range neighborsByWord {
+		sources = append(sources, word)
+	}
+	sort.Strings(sources)
+	writer := csv.NewWriter(outFile)
+	writer.Write([]string{"source_word", "neighbor_word", "score"})
+	for _, source := range sources {
+		for _, sim := range neighborsByWord[source] {
+			writer.Write([]string{source, sim.Word, strconv.FormatFloat(sim.Score, 'f', 6, 64)})
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		fatalf(exitFailure, "Error writing neighbor report: %v", err)
+	}
+	if err := outFile.Close(); err != nil {
+		fatalf(exitFailure, "Error closing neighbor report: %v", err)
+	}
+}
+
+// summarizeWords lists up to limit of words for a log line, noting how many
+// more there are.
+func summarizeWords(words []string, limit int) string {
+	if len(words) <= limit {
+		return strings.Join(words, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(words[:limit], ", "), len(words)-limit)
+}
+
+// writeProvenance writes a sorted word<TAB>source line for each word of
+// sources, which only holds words with an output line.
+func writeProvenance(outputFile string, sources map[string]string) {
+	words := make([]string, 0, len(sources))
+	for word := range sources {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	outFile, err := createOutput(outputFile)
+	if err != nil {
+		fatalf(exitFailure, "Error creating provenance file: %v", err)
+	}
+	writer := bufio.NewWriter(outFile)
+	for _, word := range words {
+		fmt.Fprintf(writer, "%s\t%s\n", word, sources[word])
+	}
+	if err := writer.Flush(); err != nil {
+		fatalf(exitFailure, "Error writing provenance file: %v", err)
+	}
+	if err := outFile.Close(); err != nil {
+		fatalf(exitFailure, "Error closing provenance file: %v", err)
+	}
+}
+
+// topNHeap keeps the n closest Similarities offered to it in a heap whose root is the
+// furthest of them, so memory stays O(n) and each offer costs O(log n) at most.
+// Equal scores are ordered by word (see Metric.ranksBefore), whatever the offer order.
+type topNHeap struct {
+	n      int
+	metric Metric
+	items  []Similarity
+}
+
+func newTopNHeap(n int, metric Metric) *topNHeap {
+	if n < 0 {
+		n = 0
+	}
+	return &topNHeap{n: n, metric: metric, items: make([]Similarity, 0, n)}
+}
+
+// heap.Interface, ordered so that the furthest kept item sits at the root.
+func (t *topNHeap) Len() int           { return len(t.items) }
+func (t *topNHeap) Less(i, j int) bool { return t.metric.ranksBefore(t.items[j], t.items[i]) }
+func (t *topNHeap) Swap(i, j int)      { t.items[i], t.items[j] = t.items[j], t.items[i] }
+func (t *topNHeap) Push(x any)         { t.items = append(t.items, x.(Similarity)) }
+func (t *topNHeap) Pop() any {
+	last := t.items[len(t.items)-1]
+	t.items = t.items[:len(t.items)-1]
+	return last
+}
+
+func (t *topNHeap) offer(sim Similarity) {
+	if len(t.items) < t.n {
+		heap.Push(t, sim)
+	} else if t.n > 0 && t.metric.ranksBefore(sim, t.items[0]) {
+		t.items[0] = sim
+		heap.Fix(t, 0)
+	}
+}
+
+// sorted returns the kept items closest first.
+func (t *topNHeap) sorted() []Similarity {
+	result := append([]Similarity(nil), t.items...)
+	sort.Slice(result, func(i, j int) bool {
+		return t.metric.ranksBefore(result[i], result[j])
+	})
+	return result
+}
+
+// writePrunedFile copies the lines of inputFile whose word is in finalVocab.
+// With loadOpts.Lowercase, finalVocab holds lowercased model words: lines are matched on
+// their lowercased word, which is also what gets written unless preserveCase.
+// A positive dim keeps only that many components of each copied line, and lines
+// are reformatted with formatVector if -precision or -delimiter was given.
+// sortWords buffers the copied lines and writes them sorted by word instead of
+// in input order.
+func writePrunedFile(inputFile, outputFile string, finalVocab map[string]bool, loadOpts *loadOptions, preserveCase bool, dim int, sortWords bool) (err error) {
+	foldCase := loadOpts.Lowercase
+	inFile, err := openInput(inputFile)
+	if err != nil {
+		return withExitCode(exitMissingInput, fmt.Errorf("opening GloVe file for writing: %w", err))
+	}
+	defer inFile.Close()
+	outFile, err := createOutput(outputFile)
+	if err != nil {
+		return withExitCode(exitFailure, fmt.Errorf("creating output file: %w", err))
+	}
+	defer func() {
+		if err != nil {
+			abortOutput(outFile)
+		}
+	}()
+	writer := newOutputWriter(outFile)
+	scanner := newLineScanner(inFile)
+	linesWritten := 0
+	type sortedLine struct{ word, line string }
+	var buffered []sortedLine
+	started := false
+	progress := newProgress("lines scanned for writing:", progressInterval, 0)
+	for scanner.Scan() {
+		progress.tick()
+		line := scanner.Text()
+		if !loadOpts.TabWord {
+			// Indented lines load by the word after the indent, as in splitVectorLine
+			line = strings.TrimLeft(line, " \t")
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		// A header counts the whole model, so it can't be copied to the pruned file
+		if _, _, ok := parseHeader(line); !started && (ok || loadOpts.SkipHeader) {
+			started = true
+			continue
+		}
+		started = true
+		word := lineWord(line)
+		if loadOpts.TabWord {
+			word, _, _ = strings.Cut(line, "\t")
+		}
+		// word is matched against finalVocab; written replaces it in the line
+		original, written := word, word
+		if loadOpts.TrimWord {
+			word = trimWord(word)
+			// A space-separated line can't hold a word with a space in it, so
+			// such a word is written as it was and trimmed again on load
+			if loadOpts.TabWord || !strings.Contains(word, " ") {
+				written = word
+			}
+		}
+		if foldCase {
+			word = strings.ToLower(word)
+			if !preserveCase {
+				written = strings.ToLower(written)
+			}
+		}
+		if written != original {
+			// Lowercasing and trimming can change the byte length of the word
+			line = written + line[len(original):]
+		}
+		if !finalVocab[word] {
+			continue
+		}
+		// Rejoining the components also evens out doubled, trailing or tab
+		// separators, which readers splitting on single spaces trip over
+		name, values := splitVectorLine(line, loadOpts.TabWord)
+		if dim > 0 {
+			if err := checkTruncation(dim, len(values)); err != nil {
+				return err
+			}
+			values = values[:dim]
+		}
+		if customFormat() {
+			vec, err := parseVectorFields(values)
+			if err != nil {
+				return withExitCode(exitBadFormat, fmt.Errorf("rewriting %q: %v", name, err))
+			}
+			line = formatVector(name, vec)
+		} else {
+			line = name + " " + strings.Join(values, " ")
+		}
+		if loadOpts.TabWord {
+			// Keep the tab that lets a multi-word entry be read back
+			line = name + "\t" + line[len(name)+1:]
+		}
+		if sortWords {
+			buffered = append(buffered, sortedLine{word: written, line: line})
+			continue
+		}
+		writer.WriteString(line + "\n")
+		linesWritten++
+		if err := flushPeriodically(writer, linesWritten); err != nil {
+			return fmt.Errorf("writing output file: %w", err)
+		}
+	}
+	if err := scanError(scanner, "GloVe file for writing"); err != nil {
+		return err
+	}
+	if sortWords {
+		// A word repeated in the model keeps its lines in input order
+		sort.SliceStable(buffered, func(i, j int) bool {
+			return buffered[i].word < buffered[j].word
+		})
+		for _, sorted := range buffered {
+			writer.WriteString(sorted.line + "\n")
+			linesWritten++
+			if err := flushPeriodically(writer, linesWritten); err != nil {
+				return fmt.Errorf("writing output file: %w", err)
+			}
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("writing output file: %w", err)
+	}
+	// Closing flushes the gzip footer when compressing, so the error matters
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("closing output file: %w", err)
+	}
+	return nil
+}
+
+// existingOutputWords returns the words of a previously written output file,
+// lowercased with foldCase, or an empty set if the file doesn't exist yet.
+func existingOutputWords(outputFile string, foldCase bool) (map[string]bool, error) {
+	words := make(map[string]bool)
+	if _, err := os.Stat(outputFile); os.IsNotExist(err) {
+		logger.Printf("-> %s doesn't exist yet, so everything will be added.\n", outputFile)
+		return words, nil
+	}
+	err := readLines(outputFile, func(line string) {
+		word := lineWord(line)
+		if foldCase {
+			word = strings.ToLower(word)
+		}
+		words[word] = true
+	})
+	return words, err
+}
+
+// appendLines replaces outputFile with its current lines followed by those of extraFile.
+func appendLines(outputFile, extraFile string) (err error) {
+	var sources []string
+	if _, err := os.Stat(outputFile); err == nil {
+		sources = append(sources, outputFile)
+	}
+	sources = append(sources, extraFile)
+	outFile, err := createOutput(outputFile)
+	if err != nil {
+		return withExitCode(exitFailure, fmt.Errorf("creating output file: %w", err))
+	}
+	defer func() {
+		if err != nil {
+			abortOutput(outFile)
+		}
+	}()
+	writer := bufio.NewWriter(outFile)
+	for _, source := range sources {
+		err := readLines(source, func(line string) {
+			writer.WriteString(line + "\n")
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("writing output file: %w", err)
+	}
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("closing output file: %w", err)
+	}
+	return nil
+}
+
+// estimateOutputSize adds up the length of the lines prune would write for
+// finalVocab, streaming the model again if it wasn't kept in memory.
+func estimateOutputSize(inputFile string, loadOpts *loadOptions, gloveMap map[string]Vector, finalVocab map[string]bool, dim int) (int64, error) {
+	var size int64
+	add := func(word string, vec Vector) {
+		if dim > 0 && dim < len(vec) {
+			vec = vec[:dim]
+		}
+		size += int64(len(formatVector(word, vec))) + 1
+	}
+	if gloveMap != nil {
+		for word := range finalVocab {
+			if vec, ok := gloveMap[word]; ok {
+				add(word, vec)
+			}
+		}
+		return size, nil
+	}
+	err := readVectors(inputFile, loadOpts, func(word string, vec Vector) {
+		if finalVocab[word] {
+			add(word, vec)
+		}
+	})
+	return size, err
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. "12.3 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// checkTruncation fails if dim asks for more components than the model has.
+func checkTruncation(dim, modelDim int) error {
+	if dim > modelDim {
+		return fmt.Errorf("-dim %d exceeds the model's %d dimensions", dim, modelDim)
+	}
+	return nil
+}
+
+// writeWordList writes one word per line to outputFile, or to stderr if it is "-".
+func writeWordList(outputFile string, words []string) {
+	var out io.WriteCloser = nopWriteCloser{os.Stderr}
+	if outputFile != "-" {
+		var err error
+		if out, err = createOutput(outputFile); err != nil {
+			fatalf(exitFailure, "Error creating %s: %v", outputFile, err)
+		}
+	}
+	writer := bufio.NewWriter(out)
+	for _, word := range words {
+		writer.WriteString(word + "\n")
+	}
+	if err := writer.Flush(); err != nil {
+		fatalf(exitFailure, "Error writing output file: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		fatalf(exitFailure, "Error closing %s: %v", outputFile, err)
+	}
+}
+
+// nopWriteCloser lets stdout and stderr stand in for files we would otherwise close.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// formatVector renders a word and its vector as a single GloVe text line.
+func formatVector(word string, vec Vector) string {
+	var sb strings.Builder
+	sb.WriteString(word)
+	for _, v := range vec {
+		sb.WriteString(outputDelimiter)
+		sb.WriteString(strconv.FormatFloat(v, 'f', outputPrecision, 64))
+	}
+	return sb.String()
+}
+
+// writeVectorFile writes the vectors for words, in the given order, as a GloVe text file.
+func writeVectorFile(outputFile string, words []string, vectors map[string]Vector) (err error) {
+	outFile, err := createOutput(outputFile)
+	if err != nil {
+		return withExitCode(exitFailure, fmt.Errorf("creating output file: %w", err))
+	}
+	defer func() {
+		if err != nil {
+			abortOutput(outFile)
+		}
+	}()
+	writer := newOutputWriter(outFile)
+	for i, word := range words {
+		writer.WriteString(formatVector(word, vectors[word]) + "\n")
+		if err := flushPeriodically(writer, i+1); err != nil {
+			return fmt.Errorf("writing output file: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("writing output file: %w", err)
+	}
+	if err := outFile.Close(); err != nil {
+		return fmt.Errorf("closing output file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,973 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Progress and information lines would drown out test failures
+	logger.level = levelError
+	os.Exit(m.Run())
+}
+
+// testModel is a tiny model whose neighbor order is easy to work out by hand:
+// against cat, kitten scores 0.9986, dog 0.9939, truck 0.1104 and car 0.
+const testModel = `cat 1 0
+dog 0.9 0.1
+kitten 0.95 0.05
+car 0 1
+truck 0.1 0.9
+`
+
+// writeTestFile writes content to dir/name and returns its path.
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testPruneOptions returns the options runPrune would build with no flags but
+// -input, -vocab and -output.
+func testPruneOptions(t *testing.T, inputs []string, vocabFile, outputFile string) PruneOptions {
+	t.Helper()
+	metric, err := parseMetric("cosine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return PruneOptions{
+		Inputs:     inputs,
+		VocabFile:  vocabFile,
+		OutputFile: outputFile,
+		Load:       &loadOptions{},
+		Search:     neighborOptions{TopN: 5, Metric: metric},
+		Cap:        100000,
+		MinVotes:   1,
+		Depth:      1,
+	}
+}
+
+// outputWords returns the words of a written vector file in file order.
+func outputWords(t *testing.T, path string) []string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		words = append(words, lineWord(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return words
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name  string
+		vocab string
+		// model replaces testModel when set
+		model string
+		edit  func(*PruneOptions)
+		want  []string
+	}{
+		{
+			name:  "vault words only",
+			vocab: "cat\n",
+			edit:  func(o *PruneOptions) { o.Search.TopN = 0 },
+			want:  []string{"cat"},
+		},
+		{
+			name:  "closest neighbor",
+			vocab: "cat\n",
+			edit:  func(o *PruneOptions) { o.Search.TopN = 1 },
+			want:  []string{"cat", "kitten"},
+		},
+		{
+			name:  "two neighbors",
+			vocab: "cat\n",
+			edit:  func(o *PruneOptions) { o.Search.TopN = 2 },
+			want:  []string{"cat", "dog", "kitten"},
+		},
+		{
+			name:  "threshold",
+			vocab: "cat\n",
+			edit:  func(o *PruneOptions) { o.Search.Threshold = 0.995 },
+			want:  []string{"cat", "kitten"},
+		},
+		{
+			name:  "cap keeps the closest neighbors",
+			vocab: "cat\n",
+			edit:  func(o *PruneOptions) { o.Search.TopN, o.Cap = 3, 2 },
+			want:  []string{"cat", "kitten"},
+		},
+		{
+			name:  "cap never drops vault words",
+			vocab: "cat\ncar\n",
+			edit:  func(o *PruneOptions) { o.Search.TopN, o.Cap = 1, 1 },
+			want:  []string{"car", "cat"},
+		},
+		{
+			// kitten is cat's closest neighbor, but as a vault word it must not
+			// take the one slot the cap leaves for an added neighbor
+			name:  "cap counts only added neighbors",
+			vocab: "cat\nkitten\n",
+			edit:  func(o *PruneOptions) { o.Search.TopN, o.Cap = 3, 3 },
+			want:  []string{"cat", "dog", "kitten"},
+		},
+		{
+			name:  "vault words missing from the model are skipped",
+			vocab: "cat\nzebra\n",
+			edit:  func(o *PruneOptions) { o.Search.TopN = 1 },
+			want:  []string{"cat", "kitten"},
+		},
+		{
+			name:  "vault words with rejected lines aren't copied",
+			vocab: "cat\nfoo\nbar\n",
+			model: testModel + "foo 1 NaN\nbar 1 2 3\n",
+			edit:  func(o *PruneOptions) { o.Search.TopN = 0 },
+			want:  []string{"cat"},
+		},
+		{
+			name:  "vault words with rejected lines aren't copied when sorted",
+			vocab: "cat\nfoo\nbar\n",
+			model: testModel + "foo 1 NaN\nbar 1 2 3\n",
+			edit:  func(o *PruneOptions) { o.Search.TopN, o.Sort = 1, true },
+			want:  []string{"cat", "kitten"},
+		},
+		{
+			// cat-dog averages to kitten's vector, but has no line of its own
+			name:  "subword vault words aren't written",
+			vocab: "cat-dog\n",
+			edit:  func(o *PruneOptions) { o.Search.TopN, o.Search.Subword = 1, true },
+			want:  []string{"kitten"},
+		},
+		{
+			name:  "subword vault words aren't written with low memory",
+			vocab: "cat-dog\n",
+			edit:  func(o *PruneOptions) { o.Search.TopN, o.Search.Subword, o.LowMem = 1, true, true },
+			want:  []string{"kitten"},
+		},
+		{
+			name:  "low memory search",
+			vocab: "cat\n",
+			edit:  func(o *PruneOptions) { o.Search.TopN, o.LowMem = 2, true },
+			want:  []string{"cat", "dog", "kitten"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			content := testModel
+			if tt.model != "" {
+				content = tt.model
+			}
+			model := writeTestFile(t, dir, "model.txt", content)
+			vocab := writeTestFile(t, dir, "vocab.txt", tt.vocab)
+			output := filepath.Join(dir, "out.txt")
+			opts := testPruneOptions(t, []string{model}, vocab, output)
+			tt.edit(&opts)
+			result, err := Prune(opts)
+			if err != nil {
+				t.Fatalf("Prune: %v", err)
+			}
+			got := outputWords(t, output)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("wrote %v, want %v", got, tt.want)
+			}
+			if len(result.Sources) != len(tt.want) {
+				t.Errorf("provenance has %d words for %d written", len(result.Sources), len(tt.want))
+			}
+			if result.FromVault+result.FromNeighbors != len(tt.want) {
+				t.Errorf("result counts %d vault and %d neighbor words for %d written", result.FromVault, result.FromNeighbors, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestPruneErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		model    string
+		vocab    string
+		edit     func(o *PruneOptions, dir string)
+		wantCode int
+		wantText string
+	}{
+		{
+			name:     "missing model",
+			model:    testModel,
+			vocab:    "cat\n",
+			edit:     func(o *PruneOptions, dir string) { o.Inputs = []string{filepath.Join(dir, "nope.txt")} },
+			wantCode: exitMissingInput,
+			wantText: "opening GloVe file",
+		},
+		{
+			name:     "missing vocabulary",
+			model:    testModel,
+			vocab:    "cat\n",
+			edit:     func(o *PruneOptions, dir string) { o.VocabFile = filepath.Join(dir, "nope.txt") },
+			wantCode: exitMissingVocab,
+			wantText: "opening vocabulary file",
+		},
+		{
+			name:     "no vault word in the model",
+			model:    testModel,
+			vocab:    "zebra\n",
+			wantCode: exitNoMatches,
+			wantText: "none of the 1 vault words",
+		},
+		{
+			name:     "strict malformed line",
+			model:    testModel + "bad 1\n",
+			vocab:    "cat\n",
+			edit:     func(o *PruneOptions, dir string) { o.Load.Strict = true },
+			wantCode: exitBadFormat,
+			wantText: "has 1 dimensions, expected 2",
+		},
+		{
+			name:     "wrong expected dimension",
+			model:    testModel,
+			vocab:    "cat\n",
+			edit:     func(o *PruneOptions, dir string) { o.Load.ExpectDim = 300 },
+			wantCode: exitBadFormat,
+			wantText: "-expect-dim is 300",
+		},
+		{
+			name:     "missing output directory",
+			model:    testModel,
+			vocab:    "cat\n",
+			edit:     func(o *PruneOptions, dir string) { o.OutputFile = filepath.Join(dir, "nodir", "out.txt") },
+			wantCode: exitFailure,
+			wantText: "creating output file",
+		},
+		{
+			name:     "low memory from stdin",
+			model:    testModel,
+			vocab:    "cat\n",
+			edit:     func(o *PruneOptions, dir string) { o.Inputs, o.LowMem = []string{"-"}, true },
+			wantCode: exitFailure,
+			wantText: "-lowmem",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			model := writeTestFile(t, dir, "model.txt", tt.model)
+			vocab := writeTestFile(t, dir, "vocab.txt", tt.vocab)
+			output := filepath.Join(dir, "out.txt")
+			opts := testPruneOptions(t, []string{model}, vocab, output)
+			if tt.edit != nil {
+				tt.edit(&opts, dir)
+			}
+			_, err := Prune(opts)
+			if err == nil {
+				t.Fatal("Prune succeeded, want an error")
+			}
+			if code := exitCode(err); code != tt.wantCode {
+				t.Errorf("exit code %d, want %d (%v)", code, tt.wantCode, err)
+			}
+			if !strings.Contains(err.Error(), tt.wantText) {
+				t.Errorf("error %q doesn't mention %q", err, tt.wantText)
+			}
+			if _, err := os.Stat(output); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("a failed prune left %s behind", output)
+			}
+		})
+	}
+}
+
+func TestPruneDepth(t *testing.T) {
+	// kitten's closest word is cat and truck's is car, both vault words, so
+	// the second hop must reach past them to dog
+	dir := t.TempDir()
+	model := writeTestFile(t, dir, "model.txt", testModel)
+	vocab := writeTestFile(t, dir, "vocab.txt", "cat\ncar\n")
+	output := filepath.Join(dir, "out.txt")
+	opts := testPruneOptions(t, []string{model}, vocab, output)
+	opts.Search.TopN = 1
+	opts.Search.ExternalOnly = true
+	opts.Depth = 2
+	result, err := Prune(opts)
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	vault := map[string]bool{"cat": true, "car": true}
+	for word, similarities := range result.Neighbors {
+		if !vault[word] {
+			t.Errorf("Neighbors has %q, which isn't a vault word", word)
+		}
+		for _, sim := range similarities {
+			if vault[sim.Word] {
+				t.Errorf("vault word %q is a neighbor of %q", sim.Word, word)
+			}
+		}
+	}
+	if len(result.HopNeighbors) != 2 {
+		t.Errorf("searched from %d words on the second hop, want kitten and truck", len(result.HopNeighbors))
+	}
+	for word, similarities := range result.HopNeighbors {
+		for _, sim := range similarities {
+			if vault[sim.Word] {
+				t.Errorf("vault word %q is a second-hop neighbor of %q", sim.Word, word)
+			}
+		}
+	}
+	got := outputWords(t, output)
+	sort.Strings(got)
+	if want := []string{"car", "cat", "dog", "kitten", "truck"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wrote %v, want %v", got, want)
+	}
+}
+
+// writeWord2VecFile writes the words of a text model (as in testModel) to
+// dir/name in the binary word2vec format.
+func writeWord2VecFile(t *testing.T, dir, name, textModel string) string {
+	t.Helper()
+	gloveMap, err := parseGloveReader(strings.NewReader(textModel), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d %d\n", len(gloveMap), vectorDim(gloveMap))
+	for _, line := range strings.Split(strings.TrimSpace(textModel), "\n") {
+		word := lineWord(line)
+		buf.WriteString(word + " ")
+		for _, x := range gloveMap[word] {
+			binary.Write(&buf, binary.LittleEndian, float32(x))
+		}
+		buf.WriteString("\n")
+	}
+	return writeTestFile(t, dir, name, buf.String())
+}
+
+func TestPruneKeepOrder(t *testing.T) {
+	// truck pulls in car and cat pulls in kitten, which model order keeps apart
+	// from the alphabetical car, cat, kitten, truck
+	want := []string{"cat", "kitten", "car", "truck"}
+	tests := []struct {
+		name string
+		// setup writes the model(s) and returns the -input paths
+		setup func(t *testing.T, dir string) []string
+		edit  func(*PruneOptions)
+		want  []string
+	}{
+		{
+			name: "stdin",
+			setup: func(t *testing.T, dir string) []string {
+				file, err := os.Open(writeTestFile(t, dir, "model.txt", testModel))
+				if err != nil {
+					t.Fatal(err)
+				}
+				stdin := os.Stdin
+				os.Stdin = file
+				t.Cleanup(func() {
+					os.Stdin = stdin
+					file.Close()
+				})
+				return []string{"-"}
+			},
+			want: want,
+		},
+		{
+			name: "binary",
+			setup: func(t *testing.T, dir string) []string {
+				return []string{writeWord2VecFile(t, dir, "model.bin", testModel)}
+			},
+			want: want,
+		},
+		{
+			name: "binary with low memory",
+			setup: func(t *testing.T, dir string) []string {
+				return []string{writeWord2VecFile(t, dir, "model.bin", testModel)}
+			},
+			edit: func(o *PruneOptions) { o.LowMem = true },
+			want: want,
+		},
+		{
+			name: "binary through the cache",
+			setup: func(t *testing.T, dir string) []string {
+				return []string{writeWord2VecFile(t, dir, "model.bin", testModel)}
+			},
+			edit: func(o *PruneOptions) { o.CacheFile = filepath.Join(filepath.Dir(o.OutputFile), "model.cache") },
+			want: want,
+		},
+		{
+			name: "several models",
+			setup: func(t *testing.T, dir string) []string {
+				return []string{
+					writeTestFile(t, dir, "a.txt", "cat 1 0\ntruck 0.1 0.9\n"),
+					writeTestFile(t, dir, "b.txt", "kitten 0.95 0.05\ncar 0 1\n"),
+				}
+			},
+			want: []string{"cat", "truck", "kitten", "car"},
+		},
+		{
+			name: "several models without a search",
+			setup: func(t *testing.T, dir string) []string {
+				return []string{
+					writeTestFile(t, dir, "a.txt", "cat 1 0\ndog 0.9 0.1\ntruck 0.1 0.9\n"),
+					writeTestFile(t, dir, "b.txt", "kitten 0.95 0.05\ncar 0 1\n"),
+				}
+			},
+			edit: func(o *PruneOptions) { o.Search.TopN = 0 },
+			want: []string{"cat", "truck"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			inputs := tt.setup(t, dir)
+			vocab := writeTestFile(t, dir, "vocab.txt", "truck\ncat\n")
+			output := filepath.Join(dir, "out.txt")
+			opts := testPruneOptions(t, inputs, vocab, output)
+			opts.Search.TopN, opts.KeepOrder = 1, true
+			if tt.edit != nil {
+				tt.edit(&opts)
+			}
+			// The cache case runs twice, so the second run reads what the first wrote
+			runs := 1
+			if opts.CacheFile != "" {
+				runs = 2
+			}
+			for run := 0; run < runs; run++ {
+				if _, err := Prune(opts); err != nil {
+					t.Fatalf("Prune: %v", err)
+				}
+				if got := outputWords(t, output); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("run %d wrote %v, want %v", run+1, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadModelCache(t *testing.T) {
+	gloveMap, err := parseGloveReader(strings.NewReader(testModel), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := []string{"cat", "dog", "kitten", "car", "truck"}
+	cacheFile := filepath.Join(t.TempDir(), "model.cache")
+	if err := writeModelCache(cacheFile, "key", gloveMap, order); err != nil {
+		t.Fatal(err)
+	}
+	intact, err := os.ReadFile(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotMap, gotOrder, err := readModelCache(cacheFile, "key")
+	if err != nil {
+		t.Fatalf("reading an intact cache: %v", err)
+	}
+	if !reflect.DeepEqual(gotMap, gloveMap) || !reflect.DeepEqual(gotOrder, order) {
+		t.Errorf("read back %v in order %v, want %v in order %v", gotMap, gotOrder, gloveMap, order)
+	}
+
+	// The count and dim follow the magic and key lines
+	countAt := len(modelCacheMagic+"\n") + len("key\n")
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+	}{
+		{"huge count", func(data []byte) []byte {
+			binary.LittleEndian.PutUint64(data[countAt:], 1<<62)
+			return data
+		}},
+		{"huge dim", func(data []byte) []byte {
+			binary.LittleEndian.PutUint32(data[countAt+8:], 1<<31)
+			return data
+		}},
+		{"no dim", func(data []byte) []byte {
+			binary.LittleEndian.PutUint32(data[countAt+8:], 0)
+			return data
+		}},
+		{"huge word length", func(data []byte) []byte {
+			// A uvarint of 2^35 in place of the first word's length byte
+			return append(append(data[:countAt+12:countAt+12], 0x80, 0x80, 0x80, 0x80, 0x80, 0x01), data[countAt+13:]...)
+		}},
+		{"truncated", func(data []byte) []byte {
+			return data[:len(data)-5]
+		}},
+		{"other key", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, key := append([]byte(nil), intact...), "key"
+			if tt.corrupt != nil {
+				data = tt.corrupt(data)
+			} else {
+				key = "other"
+			}
+			if err := os.WriteFile(cacheFile, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := readModelCache(cacheFile, key); err == nil {
+				t.Error("read a corrupt cache without an error")
+			}
+		})
+	}
+}
+
+func TestModelCacheKey(t *testing.T) {
+	model := writeTestFile(t, t.TempDir(), "model.txt", testModel)
+	info, err := os.Stat(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := modelCacheKey(model, info, &loadOptions{})
+	// Each of these changes which vectors a load keeps, or how they are read
+	for _, opts := range []loadOptions{
+		{Strict: true},
+		{Binary: true},
+		{Lowercase: true},
+		{SkipHeader: true},
+		{TabWord: true},
+		{TrimWord: true},
+	} {
+		if key := modelCacheKey(model, info, &opts); key == base {
+			t.Errorf("%+v builds the same cache key as the defaults", opts)
+		}
+	}
+}
+
+func TestParseGloveReaderQuirks(t *testing.T) {
+	// quirks.vec starts with a BOM and a blank line before its "4 3" header,
+	// mixes \r\n and \n endings, separates components by double spaces and a
+	// tab, and has trailing spaces, an indented word and trailing blank lines.
+	file, err := os.Open(filepath.Join("testdata", "quirks.vec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gloveMap, err := parseGloveReader(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Vector{
+		"the":   {0.1, 0.2, 0.3},
+		"of":    {0.2, 0.1, 0.4},
+		"and":   {0.3, 0.3, 0.1},
+		"vault": {0.5, 0.4, 0.2},
+	}
+	if len(gloveMap) != len(want) {
+		t.Errorf("loaded %d words %v, want %d", len(gloveMap), sortedKeys(gloveMap), len(want))
+	}
+	for word, vec := range want {
+		got, ok := gloveMap[word]
+		if !ok {
+			t.Errorf("%q is missing from %v", word, sortedKeys(gloveMap))
+			continue
+		}
+		if len(got) != 3 {
+			t.Errorf("%q has %d dimensions, want 3", word, len(got))
+			continue
+		}
+		if !reflect.DeepEqual(got, vec) {
+			t.Errorf("%q = %v, want %v", word, got, vec)
+		}
+	}
+}
+
+// sortedKeys lists the words of gloveMap alphabetically, for error messages.
+func sortedKeys(gloveMap map[string]Vector) []string {
+	words := make([]string, 0, len(gloveMap))
+	for word := range gloveMap {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	return words
+}
+
+func TestSplitJoin(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		header bool
+		// mangle edits the chunks between split and join
+		mangle func(t *testing.T, chunks []manifestChunk)
+	}{
+		{name: "plain", input: "a 1 2\nb 1 2\nc 1 2\nd 1 2\ne 1 2\n"},
+		{name: "no final newline", input: "a 1 2\nb 1 2\nc 1 2"},
+		{name: "crlf", input: "a 1 2\r\nb 1 2\r\nc 1 2\r\n"},
+		{name: "bom", input: "\uFEFFa 1 2\nb 1 2\nc 1 2\n"},
+		{name: "numeric header", input: "5 2\r\na 1 2\r\nb 1 2\r\nc 1 2\r\nd 1 2\r\ne 1 2\r\n", header: true},
+		{name: "text header", input: "# vectors\na 1 2\nb 1 2\nc 1 2\n", header: true},
+		{
+			name:  "chunk turned crlf",
+			input: "a 1 2\nb 1 2\nc 1 2\nd 1 2\n",
+			mangle: func(t *testing.T, chunks []manifestChunk) {
+				data, err := os.ReadFile(chunks[1].File)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+				if err := os.WriteFile(chunks[1].File, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:  "chunk edited",
+			input: "a 1 2\nb 1 2\nc 1 2\nd 1 2\n",
+			mangle: func(t *testing.T, chunks []manifestChunk) {
+				writeTestFile(t, filepath.Dir(chunks[0].File), filepath.Base(chunks[0].File), "a 1 2\nb 1 3\n")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			input := writeTestFile(t, dir, "model.txt", tt.input)
+			sum := sha256.New()
+			chunks, err := splitFile(input, "", chunkLimit{lines: 2}, tt.header, sum)
+			if err != nil {
+				t.Fatalf("splitFile: %v", err)
+			}
+			if raw := sha256.Sum256([]byte(tt.input)); hex.EncodeToString(raw[:]) != hex.EncodeToString(sum.Sum(nil)) {
+				t.Error("split's checksum isn't the SHA-256 of the input file")
+			}
+			if len(chunks) < 2 {
+				t.Fatalf("split into %d chunks, want at least 2", len(chunks))
+			}
+			if tt.mangle != nil {
+				tt.mangle(t, chunks)
+			}
+			parts := make([]chunkFile, len(chunks))
+			for i, chunk := range chunks {
+				parts[i] = chunkFile{path: chunk.File, number: i + 1}
+			}
+			output := filepath.Join(dir, "joined.txt")
+			_, _, digest, err := joinChunks(output, parts, tt.header)
+			if err != nil {
+				t.Fatalf("joinChunks: %v", err)
+			}
+			matches := digest == hex.EncodeToString(sum.Sum(nil))
+			if tt.mangle != nil {
+				if matches {
+					t.Error("a modified chunk still matches split's checksum")
+				}
+				return
+			}
+			if !matches {
+				t.Error("the joined chunks don't match split's checksum")
+			}
+			joined, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(joined) != tt.input {
+				t.Errorf("joined %q, want %q", joined, tt.input)
+			}
+		})
+	}
+}
+
+func TestRankNeighbors(t *testing.T) {
+	gloveMap, err := parseGloveReader(strings.NewReader(testModel), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric, err := parseMetric("cosine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		topN int
+		want []string
+	}{
+		{topN: -1, want: nil},
+		{topN: 0, want: nil},
+		{topN: 2, want: []string{"kitten", "dog"}},
+		{topN: 10, want: []string{"kitten", "dog", "truck", "car"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.topN), func(t *testing.T) {
+			var got []string
+			for _, sim := range rankNeighbors(gloveMap["cat"], gloveMap, vectorNorms(gloveMap), map[string]bool{"cat": true}, tt.topN, metric) {
+				got = append(got, sim.Word)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPendingOutputs(t *testing.T) {
+	dir := t.TempDir()
+	closed, err := createOutput(filepath.Join(dir, "closed.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(closed, "done")
+	if err := closed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"failed.txt", "failed.txt.gz"} {
+		out, err := createOutput(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintln(out, "partial")
+	}
+	// What fatalf does before exiting
+	pendingOutputs.abortAll()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if want := []string{"closed.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("left %v, want %v", names, want)
+	}
+	if n := len(pendingOutputs.files); n != 0 {
+		t.Errorf("%d outputs still pending", n)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	// A header, a tab-separated word and a malformed line are read as the
+	// other commands read them
+	const input = "4 2\na 1 2\nb 5 5\na 3 x\na 3 4\n"
+	tests := []struct {
+		name  string
+		input string
+		args  []string
+		want  string
+	}{
+		{name: "first", input: input, args: []string{"-strategy", "first"}, want: "a 1 2\nb 5 5\n"},
+		{name: "last", input: input, args: []string{"-strategy", "last"}, want: "b 5 5\na 3 4\n"},
+		{name: "average", input: input, args: []string{"-strategy", "average"}, want: "b 5 5\na 2 3\n"},
+		{
+			name:  "tab separated",
+			input: "new york\t1 2\nyork\t0 0\nnew york\t3 4\n",
+			args:  []string{"-strategy", "average", "-sep", "tab"},
+			want:  "york\t0 0\nnew york\t2 3\n",
+		},
+		{
+			// The non-breaking space collapses to a plain one, so both are "a b"
+			name:  "trimmed words",
+			input: "a\u00a0b\t1 2\n a b \t3 4\n",
+			args:  []string{"-strategy", "average", "-sep", "tab", "-trim-word"},
+			want:  "a b\t2 3\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			in := writeTestFile(t, dir, "in.txt", tt.input)
+			out := filepath.Join(dir, "out.txt")
+			runDedup(append([]string{"-input", in, "-output", out}, tt.args...))
+			got, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	const first = "x 1 0\ny 0 1\n"
+	const second = "z 1 1\nx 0 1\n"
+	tests := []struct {
+		name string
+		// inputs are the -inputs items, with "first" and "second" standing for
+		// the paths of those models
+		inputs string
+		args   []string
+		want   string
+	}{
+		{name: "first wins", inputs: "first,second", want: "x 1 0\ny 0 1\nz 1 1\n"},
+		{name: "later first wins", inputs: "second,first", want: "x 0 1\ny 0 1\nz 1 1\n"},
+		{name: "average", inputs: "first,second", args: []string{"-dedup", "average"}, want: "x 0.5 0.5\ny 0 1\nz 1 1\n"},
+		{name: "weights imply average", inputs: "first:3,second:1", want: "x 0.75 0.25\ny 0 1\nz 1 1\n"},
+		{name: "keep order", inputs: "second,first", args: []string{"-keep-order"}, want: "z 1 1\nx 0 1\ny 0 1\n"},
+		{name: "precision", inputs: "first:2,second:1", args: []string{"-precision", "2"}, want: "x 0.67 0.33\ny 0.00 1.00\nz 1.00 1.00\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(precision int) { outputPrecision = precision }(outputPrecision)
+			dir := t.TempDir()
+			paths := strings.NewReplacer(
+				"first", writeTestFile(t, dir, "first.txt", first),
+				"second", writeTestFile(t, dir, "second.txt", second),
+			)
+			out := filepath.Join(dir, "out.txt")
+			runMerge(append([]string{"-inputs", paths.Replace(tt.inputs), "-output", out}, tt.args...))
+			got, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExpression(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    []signedTerm
+		wantErr string
+	}{
+		{expr: "king - man + woman", want: []signedTerm{{"king", 1}, {"man", -1}, {"woman", 1}}},
+		{expr: "king -man +woman", want: []signedTerm{{"king", 1}, {"man", -1}, {"woman", 1}}},
+		{expr: "-cat", want: []signedTerm{{"cat", -1}}},
+		{expr: "  paris  ", want: []signedTerm{{"paris", 1}}},
+		{expr: "state-of-the-art - art", want: []signedTerm{{"state-of-the-art", 1}, {"art", -1}}},
+		{expr: "", wantErr: "empty expression"},
+		{expr: "king man", wantErr: "missing operator before \"man\""},
+		{expr: "king - - man", wantErr: "two operators in a row"},
+		{expr: "king +", wantErr: "ends with an operator"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := parseExpression(tt.expr)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("error %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuantizeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		model string
+	}{
+		{name: "unit range", model: testModel},
+		{name: "wide range", model: "big 40 -20 3\nsmall 0.01 -0.02 0.03\nzero 0 0 0\n"},
+		{name: "all zeros", model: "a 0 0\nb 0 0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			model := writeTestFile(t, dir, "model.txt", tt.model)
+			quantized := filepath.Join(dir, "model.q8")
+			restored := filepath.Join(dir, "restored.txt")
+			runQuantize([]string{"-input", model, "-output", quantized})
+			runDequantize([]string{"-input", quantized, "-output", restored})
+
+			want, err := parseGloveReader(strings.NewReader(tt.model), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(restored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			got, err := parseGloveReader(file, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sortedKeys(got), sortedKeys(want)) {
+				t.Fatalf("restored %v, want %v", sortedKeys(got), sortedKeys(want))
+			}
+			// Every component is rounded to the nearest of 255 steps spanning
+			// the largest one, so it lands within half a step of where it was
+			maxAbs := 0.0
+			for _, vec := range want {
+				for _, v := range vec {
+					maxAbs = math.Max(maxAbs, math.Abs(v))
+				}
+			}
+			tolerance := maxAbs/127/2 + 1e-9
+			for word, vec := range want {
+				for i, v := range vec {
+					if diff := math.Abs(got[word][i] - v); diff > tolerance {
+						t.Errorf("%q component %d restored as %g, %g off %g (tolerance %g)", word, i, got[word][i], diff, v, tolerance)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSplitJoinManifest(t *testing.T) {
+	const model = "5 2\na 1 2\nb 1 2\nc 1 2\nd 1 2\ne 1 2\n"
+	tests := []struct {
+		name string
+		args []string
+		// wantLines are the manifest's line counts per chunk, headers included
+		wantLines []int
+	}{
+		{name: "lines", args: []string{"-lines", "3"}, wantLines: []int{3, 3}},
+		{name: "repeated header", args: []string{"-lines", "2", "-header"}, wantLines: []int{3, 3, 2}},
+		{name: "bytes", args: []string{"-bytes", "12"}, wantLines: []int{2, 2, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			input := writeTestFile(t, dir, "model.txt", model)
+			manifestFile := filepath.Join(dir, "manifest.json")
+			runSplit(append([]string{"-input", input, "-manifest", manifestFile, "-checksum"}, tt.args...))
+
+			manifest := readManifest(manifestFile)
+			if sum := sha256.Sum256([]byte(model)); manifest.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("manifest records SHA-256 %s, want that of the input", manifest.SHA256)
+			}
+			var lines []int
+			for _, chunk := range manifest.Chunks {
+				lines = append(lines, chunk.Lines)
+				info, err := os.Stat(chunk.File)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Size() != chunk.Bytes {
+					t.Errorf("%s has %d bytes, manifest says %d", chunk.File, info.Size(), chunk.Bytes)
+				}
+			}
+			if !reflect.DeepEqual(lines, tt.wantLines) {
+				t.Errorf("chunks of %v lines, want %v", lines, tt.wantLines)
+			}
+
+			output := filepath.Join(dir, "joined.txt")
+			runJoin([]string{"-manifest", manifestFile, "-output", output})
+			joined, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(joined) != model {
+				t.Errorf("joined %q, want %q", joined, model)
+			}
+		})
+	}
+}